@@ -14,10 +14,15 @@ import (
 	"io"
 	"log"
 	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/aceviralltd/github-backup/internal/config"
 	awsService "github.com/aceviralltd/github-backup/internal/service/aws"
+	"github.com/aceviralltd/github-backup/internal/service/bundle"
+	githubService "github.com/aceviralltd/github-backup/internal/service/github"
+	"github.com/aceviralltd/github-backup/internal/service/lfs"
 	"github.com/aceviralltd/github-backup/internal/util"
 	"github.com/indeedhat/gli"
 
@@ -42,8 +47,6 @@ const (
 	AwsArchiveId = ""
 	AwsJobType   = ""
 
-	OutputFilename = "output.zip"
-
 	JobSleepTime = time.Minute * 5
 )
 
@@ -53,12 +56,19 @@ var (
 )
 
 type BackupRestore struct {
+	PushLfs         PushLfs         `gli:"push-lfs" description:"Upload the lfs objects from a restored repo to its new remote"`
+	RestoreSettings RestoreSettings `gli:"restore-settings" description:"Re-apply the exported settings to a recreated repo"`
+	ApplyBundles    ApplyBundles    `gli:"apply-bundles" description:"Rebuild a repo from a chain of full and incremental bundles"`
+	Extract         Extract         `gli:"extract" description:"Extract a downloaded archive of any format"`
+
 	ConfigPath string `gli:"config" description:"Path to the config file"`
-	Output     string `gli:"output,o" description:"The name of the archive to download to" default:"output.zip"`
+	Output     string `gli:"output,o" description:"The name of the archive to download to" default:"output"`
+	Vault      string `gli:"vault" description:"Vault the archive is in (defaults to the vault recorded in the catalog)"`
 	Help       bool   `gli:"^help,h" description:"Show this document"`
 	ArchiveId  string `gli:"!" description:"The archive you want to download"`
 
 	cfg   *config.Config
+	vault string
 	jobId string
 }
 
@@ -79,7 +89,11 @@ func (cmd *BackupRestore) Run() int {
 		panic(err)
 	}
 
-	cmd.jobId, err = awsService.InitArchiveDownload(cmd.cfg, cmd.ArchiveId)
+	if cmd.vault = cmd.findVault(logger); cmd.vault == "" {
+		return ErrConfig
+	}
+
+	cmd.jobId, err = awsService.InitArchiveDownload(cmd.cfg, cmd.vault, cmd.ArchiveId)
 	if err != nil {
 		panic(err)
 	}
@@ -91,6 +105,14 @@ func (cmd *BackupRestore) Run() int {
 	cmd.awaitJobCompletion(ctx, client)
 	cmd.downloadFile(ctx, client)
 
+	// the archive name is lost in glacier so the format is only known once it is downloaded
+	format, err := util.DetectFormat(cmd.Output)
+	if err != nil {
+		logger.Printf("ERROR: %s\n", err)
+		return ErrAws
+	}
+
+	logger.Printf("downloaded %s archive to %s\n", format, cmd.Output)
 	return 0
 }
 
@@ -113,6 +135,23 @@ func (cmd *BackupRestore) loadConfig(logger *log.Logger) bool {
 	return true
 }
 
+// findVault the archive was uploaded to, the configured vault has the current date appended so it only
+// holds the archives of todays run
+func (cmd *BackupRestore) findVault(logger *log.Logger) string {
+	if cmd.Vault != "" {
+		return cmd.Vault
+	}
+
+	archive, ok := config.FindArchive(cmd.cfg, cmd.ArchiveId)
+	if !ok || archive.Vault == "" {
+		logger.Printf("ERROR: archive %s is not in the catalog, set the vault with --vault\n", cmd.ArchiveId)
+		return ""
+	}
+
+	logger.Printf("found archive %s (%s) in vault %s\n", cmd.ArchiveId, archive.Description, archive.Vault)
+	return archive.Vault
+}
+
 // awaitJobCompletion for glacier retrieval
 func (cmd *BackupRestore) awaitJobCompletion(ctx context.Context, client *glacier.Client) {
 	fmt.Println("Waiting for glacier job to complete")
@@ -132,14 +171,14 @@ func (cmd *BackupRestore) downloadFile(ctx context.Context, client *glacier.Clie
 	output, err := client.GetJobOutput(ctx, &glacier.GetJobOutputInput{
 		AccountId: aws.String(cmd.cfg.Aws.AccountId),
 		JobId:     aws.String(cmd.jobId),
-		VaultName: aws.String(cmd.cfg.Aws.Vault),
+		VaultName: aws.String(cmd.vault),
 	})
 
 	if err != nil {
 		panic(err)
 	}
 
-	outFile, err := os.Create(OutputFilename)
+	outFile, err := os.Create(cmd.Output)
 	if err != nil {
 		panic(err)
 	}
@@ -153,7 +192,7 @@ func (cmd *BackupRestore) downloadFile(ctx context.Context, client *glacier.Clie
 
 // jobIsComplete checks if the given job id has finished processing on the aws servers
 func (cmd *BackupRestore) jobIsComplete(ctx context.Context, client *glacier.Client, jobId string) bool {
-	for _, job := range awsService.ListCurrentJobs(ctx, cmd.cfg, client).JobList {
+	for _, job := range awsService.ListCurrentJobs(ctx, cmd.cfg, cmd.vault, client).JobList {
 		if *job.JobId != jobId {
 			continue
 		}
@@ -164,6 +203,173 @@ func (cmd *BackupRestore) jobIsComplete(ctx context.Context, client *glacier.Cli
 	return false
 }
 
+// PushLfs uploads the lfs objects stored in an extracted backup archive
+//
+// the refs need pushing first (git push --mirror <remote>) as the server will only accept objects
+// for repos that exist
+type PushLfs struct {
+	ConfigPath string `gli:"config" description:"Path to the config file"`
+	Endpoint   string `gli:"endpoint" description:"Overwrite the lfs server url derived from the remote"`
+	Help       bool   `gli:"^help,h" description:"Show this document"`
+	RepoPath   string `gli:"!" description:"Path to the bare repo extracted from the archive"`
+	Remote     string `gli:"!" description:"Url of the git remote the repo was pushed to"`
+}
+
+// Run the command logic
+func (cmd *PushLfs) Run() int {
+	logger := log.New(os.Stdout, "lfs: ", log.LstdFlags)
+
+	cfg, err := config.LoadConfig(cmd.ConfigPath)
+	if err != nil {
+		logger.Printf("ERROR: %s\n", err)
+		return ErrConfig
+	}
+
+	endpoint := cmd.Endpoint
+	if endpoint == "" {
+		endpoint = lfs.Endpoint(cmd.Remote)
+	}
+
+	err = lfs.Push(logger, cmd.RepoPath, lfs.Remote{
+		Endpoint: endpoint,
+		Username: cfg.Github.Username,
+		Password: cfg.Github.Password,
+	})
+
+	if err != nil {
+		logger.Printf("ERROR: %s\n", err)
+		return ErrGithub
+	}
+
+	return ErrNone
+}
+
+// NeedHelp makes the decision if the help document should be shown or not
+func (cmd *PushLfs) NeedHelp() bool {
+	return cmd.Help
+}
+
+// RestoreSettings re-applies the settings from the metadata.json in a backup archive
+//
+// the repo needs to have been created and its refs pushed before this is run
+type RestoreSettings struct {
+	ConfigPath   string `gli:"config" description:"Path to the config file"`
+	Help         bool   `gli:"^help,h" description:"Show this document"`
+	MetadataPath string `gli:"!" description:"Path to the metadata.json extracted from the archive"`
+	Repo         string `gli:"!" description:"The repo to apply the settings to (owner/name)"`
+}
+
+// Run the command logic
+func (cmd *RestoreSettings) Run() int {
+	logger := log.New(os.Stdout, "settings: ", log.LstdFlags)
+
+	cfg, err := config.LoadConfig(cmd.ConfigPath)
+	if err != nil {
+		logger.Printf("ERROR: %s\n", err)
+		return ErrConfig
+	}
+
+	parts := strings.SplitN(cmd.Repo, "/", 2)
+	if len(parts) != 2 {
+		logger.Printf("ERROR: repo must be in the format owner/name\n")
+		return ErrConfig
+	}
+
+	if err = githubService.RestoreSettings(cfg, cmd.MetadataPath, parts[0], parts[1], logger); err != nil {
+		logger.Printf("ERROR: %s\n", err)
+		return ErrGithub
+	}
+
+	return ErrNone
+}
+
+// NeedHelp makes the decision if the help document should be shown or not
+func (cmd *RestoreSettings) NeedHelp() bool {
+	return cmd.Help
+}
+
+// ApplyBundles rebuilds a bare repo from the bundles listed in a chain manifest
+//
+// the archives for every entry in the chain need downloading and extracting first
+type ApplyBundles struct {
+	Help        bool   `gli:"^help,h" description:"Show this document"`
+	BundleDir   string `gli:"bundle-dir" description:"Directory containing the extracted bundles (defaults to the manifest dir)"`
+	ChainPath   string `gli:"!" description:"Path to the <repo>.bundles.json extracted from the latest archive"`
+	Destination string `gli:"!" description:"Path to create the bare repo at"`
+}
+
+// Run the command logic
+func (cmd *ApplyBundles) Run() int {
+	logger := log.New(os.Stdout, "bundle: ", log.LstdFlags)
+
+	chain, err := bundle.LoadChain(cmd.ChainPath)
+	if err != nil {
+		logger.Printf("ERROR: %s\n", err)
+		return ErrConfig
+	}
+
+	bundleDir := cmd.BundleDir
+	if bundleDir == "" {
+		bundleDir = path.Dir(cmd.ChainPath)
+	}
+
+	for _, entry := range chain.Entries {
+		logger.Printf("applying %s (archive %s)\n", entry.File, entry.ArchiveId)
+
+		if err = bundle.Apply(cmd.Destination, path.Join(bundleDir, entry.File)); err != nil {
+			logger.Printf("ERROR: %s\n", err)
+			return ErrConfig
+		}
+	}
+
+	return ErrNone
+}
+
+// NeedHelp makes the decision if the help document should be shown or not
+func (cmd *ApplyBundles) NeedHelp() bool {
+	return cmd.Help
+}
+
+// Extract unpacks an archive downloaded from glacier, the format is detected from its contents
+//
+// archives made before entries were named relative to the download dir are extracted to the same layout
+// by stripping the root and mirror dirs of the config (or the given legacy roots) from their paths
+type Extract struct {
+	ConfigPath  string   `gli:"config" description:"Path to the config file"`
+	LegacyRoots []string `gli:"legacy-root" description:"Dir (glob) old archives were made from, defaults to <root_dir>/* and mirror_dir"`
+	Help        bool     `gli:"^help,h" description:"Show this document"`
+	ArchivePath string   `gli:"!" description:"Path to the downloaded archive"`
+	Destination string   `gli:"!" description:"Directory to extract the archive into"`
+}
+
+// Run the command logic
+func (cmd *Extract) Run() int {
+	logger := log.New(os.Stdout, "extract: ", log.LstdFlags)
+
+	legacyRoots := cmd.LegacyRoots
+	if len(legacyRoots) == 0 {
+		if cfg, err := config.LoadConfig(cmd.ConfigPath); err == nil {
+			legacyRoots = cfg.Path.LegacyArchiveRoots()
+		} else {
+			logger.Printf("no config found, old archives will be extracted with their full paths: %s\n", err)
+		}
+	}
+
+	format, err := util.ExtractArchive(cmd.ArchivePath, cmd.Destination, legacyRoots)
+	if err != nil {
+		logger.Printf("ERROR: %s\n", err)
+		return ErrConfig
+	}
+
+	logger.Printf("extracted %s archive to %s\n", format, cmd.Destination)
+	return ErrNone
+}
+
+// NeedHelp makes the decision if the help document should be shown or not
+func (cmd *Extract) NeedHelp() bool {
+	return cmd.Help
+}
+
 func main() {
 	app := gli.NewApplication(&BackupRestore{}, "Restore a backup from glacier")
 	app.Run()
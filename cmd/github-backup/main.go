@@ -1,12 +1,18 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
+	"sort"
 
 	"github.com/aceviralltd/github-backup/internal/config"
 	"github.com/aceviralltd/github-backup/internal/service/aws"
+	giteaService "github.com/aceviralltd/github-backup/internal/service/gitea"
 	githubService "github.com/aceviralltd/github-backup/internal/service/github"
+	gitlabService "github.com/aceviralltd/github-backup/internal/service/gitlab"
+	remoteService "github.com/aceviralltd/github-backup/internal/service/remote"
+	"github.com/aceviralltd/github-backup/internal/source"
 	"github.com/aceviralltd/github-backup/internal/util"
 	"github.com/aceviralltd/github-backup/internal/worker"
 
@@ -18,6 +24,8 @@ const (
 	ErrConfig = 1
 	ErrGithub = 2
 	ErrAws    = 3
+	ErrSource = 4
+	ErrDisk   = 5
 )
 
 // GithubBackup is used by the gli framework to provide the cli application entry point
@@ -26,6 +34,19 @@ type GithubBackup struct {
 	ConfigPath string `gli:"config" description:"Path to the config file"`
 	Help       bool   `gli:"^help,h" description:"Show this document"`
 
+	Include       []string `gli:"include" description:"Only back up repos matching the name glob (or /regex/)"`
+	Exclude       []string `gli:"exclude" description:"Skip repos matching the name glob (or /regex/)"`
+	Topics        []string `gli:"topic" description:"Only back up repos with the given topic"`
+	ExcludeTopics []string `gli:"exclude-topic" description:"Skip repos with the given topic"`
+	Visibility    []string `gli:"visibility" description:"Only back up repos with the given visibility (public, private, internal)"`
+	Languages     []string `gli:"language" description:"Only back up repos with the given primary language"`
+	Forks         string   `gli:"forks" description:"Include, exclude or only back up forked repos"`
+	Archived      string   `gli:"archived" description:"Include, exclude or only back up archived repos"`
+	MinSize       int      `gli:"min-size" description:"Skip repos smaller than the given size in KB"`
+	MaxSize       int      `gli:"max-size" description:"Skip repos larger than the given size in KB"`
+	PushedAfter   string   `gli:"pushed-after" description:"Skip repos last pushed before the given date or duration"`
+	PushedBefore  string   `gli:"pushed-before" description:"Skip repos last pushed after the given date or duration"`
+
 	cfg *config.Config
 }
 
@@ -39,29 +60,68 @@ func (cmd *GithubBackup) Run() int {
 		return ErrConfig
 	}
 
-	logger.Println("listing repos")
-	repos, err := githubService.ListRepos(cmd.cfg)
+	sources, err := cmd.sources()
 	if err != nil {
 		logger.Printf("ERROR: %s\n", err)
-		return ErrGithub
+		return ErrConfig
+	}
+
+	var selected []*source.Repository
+	repos := make(map[source.Source][]*source.Repository)
+
+	for _, src := range sources {
+		logger.Printf("listing %s repos\n", src.Name())
+		if repos[src], err = src.ListRepos(); err != nil {
+			logger.Printf("ERROR: %s\n", err)
+			return ErrSource
+		}
+
+		logger.Printf("%d %s repos selected for backup\n", len(repos[src]), src.Name())
+		selected = append(selected, repos[src]...)
+	}
+
+	if err = worker.PlanDiskSpace(logger, cmd.cfg, selected); err != nil {
+		logger.Printf("ERROR: %s\n", err)
+		return ErrDisk
 	}
 
-	if err = aws.CreateGlacierVault(cmd.cfg); err != nil {
+	if err = aws.CreateGlacierVault(cmd.cfg, cmd.cfg.Aws.Vault); err != nil {
 		logger.Printf("ERROR: %s\n", err)
 		return ErrAws
 	}
 
-	worker.InitializeArchiveWorker(cmd.cfg, len(repos))
-	worker.InitializeGlacearWorker(cmd.cfg, len(repos))
+	if cmd.cfg.ActionsVault() != cmd.cfg.Aws.Vault {
+		if err = aws.CreateGlacierVault(cmd.cfg, cmd.cfg.ActionsVault()); err != nil {
+			logger.Printf("ERROR: %s\n", err)
+			return ErrAws
+		}
+	}
+
+	worker.InitializeArchiveWorker(cmd.cfg, len(selected))
+	worker.InitializeGlacearWorker(cmd.cfg, len(selected))
 
 	logger.Println("cloning repos")
-	for _, repo := range repos {
-		worker.ProcessRepo(logger, cmd.cfg, repo)
+	for _, src := range sources {
+		for _, repo := range repos[src] {
+			worker.ProcessRepo(logger, cmd.cfg, src, repo)
+		}
 	}
 
 	close(worker.ArciveQueue)
 	worker.WaitGroup.Wait()
 
+	// github is always the first source when it is enabled
+	if cmd.cfg.Export.Org && cmd.cfg.Github.OrgName != "" {
+		worker.BackupOrgSnapshot(logger, cmd.cfg, repos[sources[0]])
+	}
+
+	worker.BackupCatalog(logger, cmd.cfg)
+	logFailures(logger)
+
+	if cmd.cfg.Github.Enabled() {
+		logger.Println(githubService.RateLimitSummary())
+	}
+
 	return ErrNone
 }
 
@@ -70,6 +130,71 @@ func (cmd *GithubBackup) NeedHelp() bool {
 	return cmd.Help
 }
 
+// logFailures will summarise the repos that could not be backed up by why they failed
+func logFailures(logger *log.Logger) {
+	counts := config.FailureCounts()
+	if len(counts) == 0 {
+		return
+	}
+
+	var categories []string
+	for category := range counts {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	for _, category := range categories {
+		logger.Printf("%d repos failed with %s errors\n", counts[category], category)
+	}
+}
+
+// sources builds the list of configured sources to back up, github is always first when enabled
+func (cmd *GithubBackup) sources() ([]source.Source, error) {
+	var sources []source.Source
+
+	if cmd.cfg.Github.Enabled() {
+		src, err := githubService.NewSource(cmd.cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, src)
+	}
+
+	if cmd.cfg.Gitlab.Enabled() {
+		src, err := gitlabService.NewSource(cmd.cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, src)
+	}
+
+	if cmd.cfg.Gitea.Enabled() {
+		src, err := giteaService.NewSource(cmd.cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, src)
+	}
+
+	if cmd.cfg.Source.Enabled() {
+		src, err := remoteService.NewSource(cmd.cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, src)
+	}
+
+	if len(sources) == 0 {
+		return nil, errors.New("no sources configured, set a github org_name, gitlab groups/projects, gitea orgs/users or [[source.git]] remotes")
+	}
+
+	return sources, nil
+}
+
 // loadConfig from file and setup the progress log
 func (cmd *GithubBackup) loadConfig(logger *log.Logger) bool {
 	var err error
@@ -83,13 +208,68 @@ func (cmd *GithubBackup) loadConfig(logger *log.Logger) bool {
 		cmd.cfg.ForceDate(cmd.Date)
 	}
 
+	cmd.applyFilterOverrides()
 	config.InitProgress(cmd.cfg)
+	config.InitCatalog(cmd.cfg)
 
 	return true
 }
 
+// applyFilterOverrides replaces the repo filters from the config file with any given on the command line
+func (cmd *GithubBackup) applyFilterOverrides() {
+	filter := &cmd.cfg.Filter
+
+	if len(cmd.Include) > 0 {
+		filter.Include = cmd.Include
+	}
+
+	if len(cmd.Exclude) > 0 {
+		filter.Exclude = cmd.Exclude
+	}
+
+	if len(cmd.Topics) > 0 {
+		filter.Topics = cmd.Topics
+	}
+
+	if len(cmd.ExcludeTopics) > 0 {
+		filter.ExcludeTopics = cmd.ExcludeTopics
+	}
+
+	if len(cmd.Visibility) > 0 {
+		filter.Visibility = cmd.Visibility
+	}
+
+	if len(cmd.Languages) > 0 {
+		filter.Languages = cmd.Languages
+	}
+
+	if cmd.Forks != "" {
+		filter.Forks = cmd.Forks
+	}
+
+	if cmd.Archived != "" {
+		filter.Archived = cmd.Archived
+	}
+
+	if cmd.MinSize > 0 {
+		filter.MinSize = cmd.MinSize
+	}
+
+	if cmd.MaxSize > 0 {
+		filter.MaxSize = cmd.MaxSize
+	}
+
+	if cmd.PushedAfter != "" {
+		filter.PushedAfter = cmd.PushedAfter
+	}
+
+	if cmd.PushedBefore != "" {
+		filter.PushedBefore = cmd.PushedBefore
+	}
+}
+
 // main is well.. main, what do you want form me?
 func main() {
-	app := gli.NewApplication(&GithubBackup{}, "Archive github repos to aws glacier")
+	app := gli.NewApplication(&GithubBackup{}, "Archive github, gitlab and gitea repos to aws glacier")
 	app.Run()
 }
@@ -15,6 +15,7 @@ require (
 	github.com/google/go-github/v34 v34.0.0
 	github.com/indeedhat/gli v0.0.0-20190619205629-8cfe00d92e3a
 	github.com/kevinburke/ssh_config v1.1.0 // indirect
+	github.com/klauspost/compress v1.13.6
 	github.com/pelletier/go-toml v1.9.0
 	github.com/sergi/go-diff v1.2.0 // indirect
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
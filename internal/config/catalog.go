@@ -0,0 +1,257 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BackupRecordFileName  = "backups.json"
+	CatalogRecordFileName = "catalogs.json"
+
+	CatalogUploaded  = "uploaded"
+	CatalogUnchanged = "unchanged"
+	CatalogFailed    = "failed"
+)
+
+// BackupRecord describes the most recent successful backup of a repo
+type BackupRecord struct {
+	Vault       string
+	ArchiveId   string
+	Description string
+	// every archive that makes up the backup, this includes the separate releases and actions archives
+	Archives []ArchiveRecord `json:",omitempty"`
+	// format of the archive, empty for the zips made before the format could be configured
+	Format     string `json:",omitempty"`
+	BackedUpAt time.Time
+	// repo timestamps as listed at the time of the backup
+	PushedAt  time.Time
+	UpdatedAt time.Time
+}
+
+// ArchiveRecord is a single uploaded archive of a repo, the main archive has an empty suffix
+type ArchiveRecord struct {
+	Suffix      string `json:",omitempty"`
+	Vault       string
+	ArchiveId   string
+	Description string
+}
+
+// CatalogEntry records where the current backup of a repo lives for a single run
+//
+// unchanged repos point at the archive from a previous run, as do failed repos that have been backed up before
+type CatalogEntry struct {
+	Status string
+	// category and message of the failure for repos that could not be backed up
+	Failure string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+	// archives of a failed repo that were uploaded before the failure, the rest are retried by the next run
+	Uploaded []ArchiveRecord `json:",omitempty"`
+	BackupRecord
+}
+
+var (
+	LastBackups map[string]*BackupRecord
+	RunCatalog  map[string]*CatalogEntry
+
+	catalogMux sync.Mutex
+)
+
+// InitCatalog loads the last backup records from the state dir and the catalog for the current run
+func InitCatalog(config *Config) {
+	catalogMux.Lock()
+	defer catalogMux.Unlock()
+
+	LastBackups = make(map[string]*BackupRecord)
+	RunCatalog = make(map[string]*CatalogEntry)
+
+	readStateFile(path.Join(config.Path.StateDir, BackupRecordFileName), &LastBackups)
+	readStateFile(config.Path.CatalogPath(), &RunCatalog)
+}
+
+// LastBackup will find the most recent successful backup for the repo (if any)
+func LastBackup(repoName string) (BackupRecord, bool) {
+	catalogMux.Lock()
+	defer catalogMux.Unlock()
+
+	record, ok := LastBackups[repoName]
+	if !ok {
+		return BackupRecord{}, false
+	}
+
+	return *record, true
+}
+
+// RecordBackup stores a successful upload as both the last backup of the repo and in the run catalog
+func RecordBackup(config *Config, repoName string, record BackupRecord) {
+	catalogMux.Lock()
+	defer catalogMux.Unlock()
+
+	LastBackups[repoName] = &record
+	writeStateFile(path.Join(config.Path.StateDir, BackupRecordFileName), LastBackups)
+
+	RunCatalog[repoName] = &CatalogEntry{Status: CatalogUploaded, BackupRecord: record}
+	writeStateFile(config.Path.CatalogPath(), RunCatalog)
+}
+
+// RecordCatalogUpload stores where the run catalog was uploaded to, keyed by the date of the run
+func RecordCatalogUpload(config *Config, record ArchiveRecord) {
+	catalogMux.Lock()
+	defer catalogMux.Unlock()
+
+	filePath := path.Join(config.Path.StateDir, CatalogRecordFileName)
+
+	uploads := make(map[string]ArchiveRecord)
+	readStateFile(filePath, &uploads)
+
+	uploads[config.Path.date()] = record
+	writeStateFile(filePath, uploads)
+}
+
+// RecordUnchanged adds the previous backup of the repo to the run catalog
+func RecordUnchanged(config *Config, repoName string, record BackupRecord) {
+	catalogMux.Lock()
+	defer catalogMux.Unlock()
+
+	RunCatalog[repoName] = &CatalogEntry{Status: CatalogUnchanged, BackupRecord: record}
+	writeStateFile(config.Path.CatalogPath(), RunCatalog)
+}
+
+// RecordFailure adds a repo that could not be backed up to the run catalog along with why
+func RecordFailure(config *Config, repoName, category string, err error) {
+	catalogMux.Lock()
+	defer catalogMux.Unlock()
+
+	entry := &CatalogEntry{Status: CatalogFailed, Failure: category, Error: err.Error()}
+	if record, ok := LastBackups[repoName]; ok {
+		entry.BackupRecord = *record
+	}
+
+	RunCatalog[repoName] = entry
+	writeStateFile(config.Path.CatalogPath(), RunCatalog)
+}
+
+// RecordPartialUpload adds the archives that were uploaded before a repo failed to its run catalog entry
+// so they can still be found when restoring
+func RecordPartialUpload(config *Config, repoName string, archives []ArchiveRecord) {
+	catalogMux.Lock()
+	defer catalogMux.Unlock()
+
+	entry, ok := RunCatalog[repoName]
+	if !ok {
+		return
+	}
+
+	entry.Uploaded = archives
+	writeStateFile(config.Path.CatalogPath(), RunCatalog)
+}
+
+// FailureCounts totals the failed repos in the run catalog by their failure category
+func FailureCounts() map[string]int {
+	catalogMux.Lock()
+	defer catalogMux.Unlock()
+
+	counts := make(map[string]int)
+	for _, entry := range RunCatalog {
+		if entry.Status == CatalogFailed {
+			counts[entry.Failure]++
+		}
+	}
+
+	return counts
+}
+
+// FindArchive will look up the record of an uploaded archive by its id in the last backup records, the
+// uploaded run catalogs and every run catalog in the state dir, this is where the vault the archive was
+// uploaded to is kept
+func FindArchive(config *Config, archiveId string) (ArchiveRecord, bool) {
+	records := make(map[string]*BackupRecord)
+	readStateFile(path.Join(config.Path.StateDir, BackupRecordFileName), &records)
+
+	if archive, ok := findArchive(records, archiveId); ok {
+		return archive, true
+	}
+
+	uploads := make(map[string]ArchiveRecord)
+	readStateFile(path.Join(config.Path.StateDir, CatalogRecordFileName), &uploads)
+
+	for _, upload := range uploads {
+		if upload.ArchiveId == archiveId {
+			return upload, true
+		}
+	}
+
+	catalogs, _ := filepath.Glob(path.Join(config.Path.StateDir, "catalogs", "*.json"))
+	sort.Sort(sort.Reverse(sort.StringSlice(catalogs)))
+
+	for _, catalogPath := range catalogs {
+		catalog := make(map[string]*CatalogEntry)
+		readStateFile(catalogPath, &catalog)
+
+		records = make(map[string]*BackupRecord)
+		for name, entry := range catalog {
+			records[name] = &entry.BackupRecord
+
+			for _, archive := range entry.Uploaded {
+				if archive.ArchiveId == archiveId {
+					return archive, true
+				}
+			}
+		}
+
+		if archive, ok := findArchive(records, archiveId); ok {
+			return archive, true
+		}
+	}
+
+	return ArchiveRecord{}, false
+}
+
+// findArchive checks the archives of each record, records made before the archives were listed only
+// have the main archive
+func findArchive(records map[string]*BackupRecord, archiveId string) (ArchiveRecord, bool) {
+	for _, record := range records {
+		for _, archive := range record.Archives {
+			if archive.ArchiveId == archiveId {
+				return archive, true
+			}
+		}
+
+		if record.ArchiveId == archiveId {
+			return ArchiveRecord{Vault: record.Vault, ArchiveId: record.ArchiveId, Description: record.Description}, true
+		}
+	}
+
+	return ArchiveRecord{}, false
+}
+
+// readStateFile will load the json file into target, missing files are left as the empty target
+func readStateFile(filePath string, target interface{}) {
+	if _, err := os.Stat(filePath); err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err == nil {
+		_ = json.Unmarshal(data, target)
+	}
+}
+
+// writeStateFile will store data as json at the file path
+func writeStateFile(filePath string, data interface{}) {
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		log.Println("Failed to update " + path.Base(filePath))
+		return
+	}
+
+	_ = os.MkdirAll(path.Dir(filePath), 0755)
+	_ = ioutil.WriteFile(filePath, encoded, 0644)
+}
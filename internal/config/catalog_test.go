@@ -0,0 +1,39 @@
+package config
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFindPartialUpload(t *testing.T) {
+	cfg := &Config{}
+	cfg.Path.StateDir = t.TempDir()
+	cfg.Path.ForceDate = "2021-06-01"
+
+	InitCatalog(cfg)
+
+	uploaded := []ArchiveRecord{{Vault: "backups", ArchiveId: "repo-archive", Description: "org/repo.tar.gz"}}
+
+	RecordFailure(cfg, "org/repo", "network", errors.New("upload of org/repo.actions.tar.gz failed"))
+	RecordPartialUpload(cfg, "org/repo", uploaded)
+
+	// repos without a catalog entry are not added by a partial upload
+	RecordPartialUpload(cfg, "org/missing", uploaded)
+
+	// the restore reads the catalog back from the state dir
+	InitCatalog(cfg)
+
+	entry, ok := RunCatalog["org/repo"]
+	if !ok || entry.Status != CatalogFailed || len(entry.Uploaded) != 1 {
+		t.Fatalf("expected a failed entry with the uploaded archive, got %+v", entry)
+	}
+
+	if _, ok = RunCatalog["org/missing"]; ok {
+		t.Error("expected no entry for a repo that was never recorded")
+	}
+
+	archive, ok := FindArchive(cfg, "repo-archive")
+	if !ok || archive.Vault != "backups" {
+		t.Errorf("expected the partially uploaded archive to be found, got %+v", archive)
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -8,7 +9,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/google/go-github/v34/github"
+	"github.com/aceviralltd/github-backup/internal/source"
 	"github.com/pelletier/go-toml"
 )
 
@@ -16,13 +17,45 @@ const (
 	ConfigFile        = ".ghb.toml"
 	DefaultRoodDir    = "backup"
 	DefaultLogDir     = "logs"
+	DefaultStateDir   = "state"
 	DefaultDateFormat = "2006-01-02"
 )
 
+const (
+	FilterInclude = "include"
+	FilterExclude = "exclude"
+	FilterOnly    = "only"
+)
+
+const (
+	ArchiveZip    = "zip"
+	ArchiveTarGz  = "tar.gz"
+	ArchiveTarZst = "tar.zst"
+)
+
+const (
+	DiskThrottle = "throttle"
+	DiskAbort    = "abort"
+)
+
+const (
+	ProtocolHttps = "https"
+	ProtocolSsh   = "ssh"
+)
+
 type Config struct {
-	Github githubConfig
-	Path   pathConfig
-	Aws    awsConfig
+	Github  githubConfig
+	Gitlab  gitlabConfig
+	Gitea   giteaConfig
+	Source  sourceConfig
+	Path    pathConfig
+	Aws     awsConfig
+	Filter  filterConfig
+	Export  exportConfig
+	Backup  backupConfig
+	Clone   cloneConfig
+	Archive archiveConfig
+	Disk    diskConfig
 
 	GitBin string `toml:"git_bin"`
 }
@@ -36,6 +69,15 @@ func (c *Config) ArchiveDescription(repo string) string {
 	)
 }
 
+// ActionsVault will return the name of the vault that actions archives should be uploaded to
+func (c *Config) ActionsVault() string {
+	if c.Export.ActionsVault != "" {
+		return c.Export.ActionsVault
+	}
+
+	return c.Aws.Vault
+}
+
 // ForceDate sets the PathConfig.ForceDate string to force the tool to use a specific date
 func (c *Config) ForceDate(dateString string) {
 	c.Path.ForceDate = dateString
@@ -46,6 +88,249 @@ type githubConfig struct {
 	Password     string
 	OrgName      string `toml:"org_name"`
 	SkipArchived bool   `toml:"skip_archived"`
+	Wikis        bool   `default:"true"`
+	Lfs          bool   `default:"true"`
+	// cache api responses in the state dir and make conditional requests on following runs
+	EtagCache bool `toml:"etag_cache" default:"true"`
+	// users to back up gists for, public gists only unless it is the configured user
+	GistUsers []string `toml:"gist_users"`
+	// include the public gists of every org member (when the user is permitted to list them)
+	OrgMemberGists bool `toml:"org_member_gists"`
+	// https or ssh
+	Protocol string `default:"https"`
+	Ssh      SshConfig
+}
+
+// Enabled checks if there is anything to back up from github
+func (c githubConfig) Enabled() bool {
+	return c.OrgName != "" || len(c.GistUsers) > 0
+}
+
+type gitlabConfig struct {
+	// api root of the instance, for self hosted instances this is the instance url
+	BaseUrl string `toml:"base_url" default:"https://gitlab.com"`
+	// personal, group or project access token with read_api and read_repository
+	Token string
+	// full paths of groups to back up, projects in subgroups are included
+	Groups []string
+	// full paths of individual projects to back up (group/project)
+	Projects []string
+	Wikis    bool `default:"true"`
+	Lfs      bool `default:"true"`
+	// https or ssh
+	Protocol string `default:"https"`
+	Ssh      SshConfig
+}
+
+// Enabled checks if any gitlab groups or projects have been configured
+func (c gitlabConfig) Enabled() bool {
+	return len(c.Groups) > 0 || len(c.Projects) > 0
+}
+
+// giteaConfig also covers forgejo which shares the same api
+type giteaConfig struct {
+	// url of the instance, there is no public default
+	BaseUrl string `toml:"base_url"`
+	// user that owns the token, used along with it for https clones
+	Username string
+	// access token with read access to the repos (and organisation for org repos)
+	Token string
+	// organisations to back up every repo of
+	Orgs []string
+	// users to back up the repos of, private repos are only included for the token owner
+	Users []string
+	Wikis bool `default:"true"`
+	Lfs   bool `default:"true"`
+	// https or ssh
+	Protocol string `default:"https"`
+	Ssh      SshConfig
+}
+
+// Enabled checks if any gitea orgs or users have been configured
+func (c giteaConfig) Enabled() bool {
+	return len(c.Orgs) > 0 || len(c.Users) > 0
+}
+
+type sourceConfig struct {
+	// remotes to back up directly without a hosting api
+	Git []GitRemoteConfig
+}
+
+// Enabled checks if any git remotes have been configured
+func (c sourceConfig) Enabled() bool {
+	return len(c.Git) > 0
+}
+
+// GitRemoteConfig is a single remote listed in a [[source.git]] section
+type GitRemoteConfig struct {
+	// unique name of the repo, it is archived as git/<name>
+	Name string
+	// https or ssh (ssh:// or scp style) url to clone
+	Url string
+	// https only
+	Username string
+	// name of the environment variable holding the password or token, this keeps secrets out of
+	// the config file
+	PasswordEnv string `toml:"password_env"`
+	// fetch lfs objects, only supported for https remotes
+	Lfs bool
+	// ssh key settings, defaulting to the ssh-agent as with the other sources
+	Ssh SshConfig
+}
+
+// Password will resolve the password from the configured environment variable
+func (c GitRemoteConfig) Password() string {
+	if c.PasswordEnv == "" {
+		return ""
+	}
+
+	return os.Getenv(c.PasswordEnv)
+}
+
+type SshConfig struct {
+	User string `default:"git"`
+	// private key (or deploy key) to authenticate with, ssh-agent is used when not set
+	KeyPath    string `toml:"key_path"`
+	Passphrase string
+	// host keys are always checked, ~/.ssh/known_hosts is used when not set
+	KnownHosts string `toml:"known_hosts"`
+}
+
+type filterConfig struct {
+	// name globs, wrap the pattern in slashes to use a regex instead (/^api-.*$/)
+	Include []string
+	Exclude []string
+	// repos must have at least one of these topics
+	Topics        []string
+	ExcludeTopics []string `toml:"exclude_topics"`
+	// public, private or internal
+	Visibility []string
+	Languages  []string
+	// include, exclude or only
+	Forks string `default:"include"`
+	// left empty to fall back to the legacy skip_archived flag, which is include unless it is set
+	Archived string
+	// size limits in KB as reported by github
+	MinSize int `toml:"min_size"`
+	MaxSize int `toml:"max_size"`
+	// either a date in the format 2006-01-02 or a duration relative to now (720h)
+	PushedAfter  string `toml:"pushed_after"`
+	PushedBefore string `toml:"pushed_before"`
+}
+
+type exportConfig struct {
+	// issues, pull requests, comments, labels, milestones and reactions
+	Issues bool
+	// release metadata and asset binaries
+	Releases bool
+	// release assets larger than this (in MB) are uploaded as a separate archive
+	ReleaseSplitSize int64 `toml:"release_split_size" default:"512"`
+	// repo settings, branch protection, rulesets, environments and actions variables
+	Settings bool
+	// workflow definitions, recent runs with their logs and non-expired artifacts, these are kept in
+	// a separate <repo>.actions archive
+	Actions bool
+	// number of the most recent workflow runs to keep
+	ActionsRuns int `toml:"actions_runs" default:"50"`
+	// vault to upload the actions archives to, allowing a different retention from the code
+	ActionsVault string `toml:"actions_vault"`
+	// teams, members, collaborators, permissions, webhooks and deploy keys as a snapshot per run
+	Org bool
+}
+
+// ReleaseSplitBytes converts the release split size to bytes
+func (c exportConfig) ReleaseSplitBytes() int64 {
+	return c.ReleaseSplitSize * 1024 * 1024
+}
+
+type backupConfig struct {
+	// skip repos that have not been pushed to or updated since their last successful backup
+	SkipUnchanged bool `toml:"skip_unchanged"`
+	// days after which a repo is backed up again even if unchanged, 0 to never force a backup
+	MaxAge int `toml:"max_age" default:"30"`
+}
+
+// MaxAgeDuration converts the max age into a duration, 0 means there is no max age
+func (c backupConfig) MaxAgeDuration() time.Duration {
+	return time.Duration(c.MaxAge) * 24 * time.Hour
+}
+
+type cloneConfig struct {
+	// minutes allowed for the clone (and wiki/lfs) of even the smallest repo, setting this and
+	// timeout_per_gb to 0 removes the timeout
+	Timeout int `default:"10"`
+	// extra minutes allowed for each GB of the listed repo size
+	TimeoutPerGb int `toml:"timeout_per_gb" default:"30"`
+	// number of times a clone is retried after a transient (timeout, network or server) failure
+	Retries int `default:"3"`
+	// seconds before the first retry, doubled for every retry after that
+	RetryDelay int `toml:"retry_delay" default:"30"`
+}
+
+// TimeoutFor scales the clone timeout with the repo size (in KB)
+func (c cloneConfig) TimeoutFor(size int) time.Duration {
+	perGb := time.Duration(c.TimeoutPerGb) * time.Minute
+
+	return time.Duration(c.Timeout)*time.Minute + perGb*time.Duration(size)/(1024*1024)
+}
+
+// RetryDelayFor the given retry (starting at 1)
+func (c cloneConfig) RetryDelayFor(retry int) time.Duration {
+	return time.Duration(c.RetryDelay) * time.Second << uint(retry-1)
+}
+
+type diskConfig struct {
+	// GB of free space to always leave in the root dir, downloads pause while a repo would take it
+	// below this
+	MinFree int `toml:"min_free" default:"5"`
+	// what to do when the selected repos won't all fit in the root dir at once, throttle pauses
+	// downloads until earlier repos are uploaded while abort stops the run before anything is cloned
+	Insufficient string `default:"throttle"`
+	// seconds between free space checks while downloads are paused
+	PollInterval int `toml:"poll_interval" default:"30"`
+}
+
+// MinFreeBytes converts the free space floor to bytes
+func (c diskConfig) MinFreeBytes() int64 {
+	return int64(c.MinFree) * 1024 * 1024 * 1024
+}
+
+type archiveConfig struct {
+	// write the repo and wiki as git bundles (all refs) rather than archiving the bare repo dir
+	Bundle bool
+	// only bundle the objects added since the previous backup of the repo (requires bundle)
+	Incremental bool
+	// number of incremental bundles after which a new full bundle is made
+	MaxChain int `toml:"max_chain" default:"30"`
+	// format of the archives, zip, tar.gz or tar.zst
+	Format string `default:"zip"`
+	// compression level for the format (1-9 for zip and tar.gz, 1-22 for tar.zst), 0 uses its default
+	Level int
+	// write the archives straight into the upload rather than staging them on disk first
+	Stream bool `default:"true"`
+}
+
+// Extension of the archive files for the configured format
+func (c archiveConfig) Extension() string {
+	return "." + c.Format
+}
+
+// validate checks the format is supported and the level is within its range
+func (c archiveConfig) validate() error {
+	maxLevel := 9
+	switch c.Format {
+	case ArchiveZip, ArchiveTarGz:
+	case ArchiveTarZst:
+		maxLevel = 22
+	default:
+		return fmt.Errorf("unsupported archive format %s", c.Format)
+	}
+
+	if c.Level < 0 || c.Level > maxLevel {
+		return fmt.Errorf("archive level must be between 0 and %d for %s", maxLevel, c.Format)
+	}
+
+	return nil
 }
 
 type awsConfig struct {
@@ -61,7 +346,13 @@ type pathConfig struct {
 	RootDir    string `toml:"root_dir"`
 	DateFormat string `toml:"date_format" default:"2006-01-02"`
 	LogDir     string `toml:"log_dir" default:"logs"`
-	ForceDate  string
+	StateDir   string `toml:"state_dir"`
+	// keep a persistent bare mirror of each repo here and fetch into it rather than cloning every run
+	MirrorDir string `toml:"mirror_dir"`
+	ForceDate string
+
+	// extension of the configured archive format
+	archiveExt string
 }
 
 // date will return the appropriate date string for the run
@@ -79,18 +370,123 @@ func (c pathConfig) DownloadPath() string {
 }
 
 // RepoPath will build up a download loaction for the repo based on iteslf and the config
-func (c pathConfig) RepoPath(repo *github.Repository) string {
-	return path.Join(c.DownloadPath(), *repo.Name)
+//
+// with mirrors enabled this is the persistent mirror rather than a location in the download path
+func (c pathConfig) RepoPath(repo *source.Repository) string {
+	if c.MirrorDir != "" {
+		return path.Join(c.MirrorDir, repo.Name)
+	}
+
+	return path.Join(c.DownloadPath(), repo.Name)
+}
+
+// WikiPath will build up a download location for the repos wiki, this sits alongside the repo itself
+func (c pathConfig) WikiPath(repo *source.Repository) string {
+	if c.MirrorDir != "" {
+		return path.Join(c.MirrorDir, fmt.Sprintf("%s.wiki", repo.Name))
+	}
+
+	return path.Join(c.DownloadPath(), fmt.Sprintf("%s.wiki", repo.Name))
+}
+
+// BundlePath will build up a location for the git bundle of the repo alongside the repo itself
+//
+// the date is included so the bundles of an incremental chain can be extracted side by side
+func (c pathConfig) BundlePath(repo *source.Repository) string {
+	return path.Join(c.DownloadPath(), fmt.Sprintf("%s.%s.bundle", repo.Name, c.date()))
+}
+
+// WikiBundlePath will build up a location for the git bundle of the repos wiki
+func (c pathConfig) WikiBundlePath(repo *source.Repository) string {
+	return path.Join(c.DownloadPath(), fmt.Sprintf("%s.wiki.%s.bundle", repo.Name, c.date()))
+}
+
+// BundleChainPath will build up a location for the copy of the bundle chain manifest that is archived
+// with incremental bundles
+func (c pathConfig) BundleChainPath(repo *source.Repository) string {
+	return path.Join(c.DownloadPath(), fmt.Sprintf("%s.bundles.json", repo.Name))
+}
+
+// IsMirror checks if the given path is within the mirror dir, these must not be removed after archiving
+func (c pathConfig) IsMirror(dir string) bool {
+	return c.MirrorDir != "" && strings.HasPrefix(dir, c.MirrorDir+"/")
+}
+
+// MetaPath will build up a location for the exported github data (issues etc) alongside the repo
+func (c pathConfig) MetaPath(repo *source.Repository) string {
+	return path.Join(c.DownloadPath(), fmt.Sprintf("%s.meta", repo.Name))
+}
+
+// ReleasePath will build up a location for the release metadata and assets alongside the repo
+func (c pathConfig) ReleasePath(repo *source.Repository) string {
+	return path.Join(c.DownloadPath(), fmt.Sprintf("%s.releases", repo.Name))
+}
+
+// ReleaseArchivePath will build up a path to the separate release archive used for large assets
+func (c pathConfig) ReleaseArchivePath(repo *source.Repository) string {
+	return path.Join(
+		c.DownloadPath(),
+		fmt.Sprintf("%s.releases%s", repo.Name, c.archiveExt),
+	)
+}
+
+// ActionsPath will build up a location for the exported actions runs and artifacts
+func (c pathConfig) ActionsPath(repo *source.Repository) string {
+	return path.Join(c.DownloadPath(), fmt.Sprintf("%s.actions", repo.Name))
+}
+
+// ActionsArchivePath will build up a path to the separate archive for the actions export
+func (c pathConfig) ActionsArchivePath(repo *source.Repository) string {
+	return path.Join(
+		c.DownloadPath(),
+		fmt.Sprintf("%s.actions%s", repo.Name, c.archiveExt),
+	)
+}
+
+// OrgSnapshotPath will build up a path for the org configuration snapshot
+func (c pathConfig) OrgSnapshotPath(org string) string {
+	return path.Join(
+		c.DownloadPath(),
+		fmt.Sprintf("%s.org.json", org),
+	)
+}
+
+// CatalogPath will build up a path for the catalog of where each repo is backed up for the run, these
+// are kept in the state dir as a history of the runs
+func (c pathConfig) CatalogPath() string {
+	return path.Join(c.StateDir, "catalogs", fmt.Sprintf("%s.json", c.date()))
+}
+
+// RepoStatePath builds a path within the persistent state dir for the repo, unlike the other
+// paths this is shared between runs
+func (c pathConfig) RepoStatePath(repo *source.Repository, name string) string {
+	return path.Join(c.StateDir, repo.Name, name)
+}
+
+// HttpCachePath is the dir within the state dir used to cache github api responses
+func (c pathConfig) HttpCachePath() string {
+	return path.Join(c.StateDir, ".cache", "http")
 }
 
 // ArchivePath will build up a full path to the final archive for the repo
-func (c pathConfig) ArchivePath(repo *github.Repository) string {
+func (c pathConfig) ArchivePath(repo *source.Repository) string {
 	return path.Join(
 		c.DownloadPath(),
-		fmt.Sprintf("%s.zip", *repo.Name),
+		fmt.Sprintf("%s%s", repo.Name, c.archiveExt),
 	)
 }
 
+// LegacyArchiveRoots are patterns for the dirs older archives were made from, their entries were
+// named with the absolute path so these are stripped from the names when extracting
+func (c pathConfig) LegacyArchiveRoots() []string {
+	roots := []string{path.Join(c.RootDir, "*")}
+	if c.MirrorDir != "" {
+		roots = append([]string{c.MirrorDir}, roots...)
+	}
+
+	return roots
+}
+
 // LogPath will build up a path for this run of the archiver
 func (c pathConfig) LogPath() string {
 	return path.Join(
@@ -135,47 +531,159 @@ func negotiateConfigPath(pathOverride string) string {
 
 // fillConfigDefaults will fill out default values on the config as well as expanding paths
 func fillConfigDefaults(config *Config) error {
-	if config.Path.RootDir == "" {
-		pwd, err := os.Getwd()
-		if err != nil {
+	var err error
+
+	if config.Path.RootDir, err = expandPath(config.Path.RootDir, DefaultRoodDir); err != nil {
+		return err
+	}
+
+	if config.Path.LogDir, err = expandPath(config.Path.LogDir, DefaultLogDir); err != nil {
+		return err
+	}
+
+	if config.Path.StateDir == "" {
+		config.Path.StateDir = path.Join(config.Path.RootDir, DefaultStateDir)
+	} else if config.Path.StateDir, err = expandPath(config.Path.StateDir, ""); err != nil {
+		return err
+	}
+
+	if err = expandSshConfig(config.Github.Protocol, &config.Github.Ssh); err != nil {
+		return err
+	}
+
+	if err = expandSshConfig(config.Gitlab.Protocol, &config.Gitlab.Ssh); err != nil {
+		return err
+	}
+
+	if err = expandSshConfig(config.Gitea.Protocol, &config.Gitea.Ssh); err != nil {
+		return err
+	}
+
+	if err = validateGitRemotes(config.Source.Git); err != nil {
+		return err
+	}
+
+	if config.Gitea.Enabled() && config.Gitea.BaseUrl == "" {
+		return errors.New("gitea base_url is required when orgs or users are configured")
+	}
+
+	config.Gitlab.BaseUrl = strings.TrimSuffix(config.Gitlab.BaseUrl, "/")
+	config.Gitea.BaseUrl = strings.TrimSuffix(config.Gitea.BaseUrl, "/")
+
+	if config.Path.MirrorDir != "" {
+		if config.Path.MirrorDir, err = expandPath(config.Path.MirrorDir, ""); err != nil {
 			return err
 		}
+	}
 
-		config.Path.RootDir = path.Join(pwd, DefaultRoodDir)
-	} else if strings.HasPrefix(config.Path.RootDir, "./") {
-		pwd, err := os.Getwd()
-		if err != nil {
+	if config.Disk.Insufficient != DiskThrottle && config.Disk.Insufficient != DiskAbort {
+		return fmt.Errorf("unsupported disk insufficient mode %s", config.Disk.Insufficient)
+	}
+
+	if err = config.Archive.validate(); err != nil {
+		return err
+	}
+	config.Path.archiveExt = config.Archive.Extension()
+
+	// incremental bundles only make sense as bundles
+	if config.Archive.Incremental {
+		config.Archive.Bundle = true
+	}
+
+	// skip_archived predates the filter section so we keep it working when no filter is set, an explicit
+	// archived filter always wins
+	if config.Filter.Archived == "" {
+		config.Filter.Archived = FilterInclude
+		if config.Github.SkipArchived {
+			config.Filter.Archived = FilterExclude
+		}
+	}
+
+	config.Aws.Vault = fmt.Sprintf("%s_%s", config.Aws.Vault, config.Path.date())
+	if config.Export.ActionsVault != "" {
+		config.Export.ActionsVault = fmt.Sprintf("%s_%s", config.Export.ActionsVault, config.Path.date())
+	}
+
+	return nil
+}
+
+// expandSshConfig will validate the clone protocol and expand the paths in the ssh config
+func expandSshConfig(protocol string, sshConfig *SshConfig) error {
+	var err error
+
+	if protocol != ProtocolHttps && protocol != ProtocolSsh {
+		return fmt.Errorf("unsupported protocol %s", protocol)
+	}
+
+	if sshConfig.KeyPath != "" {
+		if sshConfig.KeyPath, err = expandPath(sshConfig.KeyPath, ""); err != nil {
 			return err
 		}
+	}
 
-		config.Path.RootDir = path.Join(pwd, config.Path.RootDir[2:])
-	} else if strings.HasPrefix(config.Path.RootDir, "~") {
-		home := os.Getenv("HOME")
+	if sshConfig.KnownHosts != "" {
+		if sshConfig.KnownHosts, err = expandPath(sshConfig.KnownHosts, ""); err != nil {
+			return err
+		}
+	}
 
-		config.Path.RootDir = path.Join(home, config.Path.RootDir[1:])
+	return nil
+}
+
+// validateGitRemotes checks every remote has a unique name and a url, defaults are not applied to
+// array tables so they are filled in here
+func validateGitRemotes(remotes []GitRemoteConfig) error {
+	names := make(map[string]bool)
+
+	for i := range remotes {
+		remote := &remotes[i]
+
+		if remote.Name == "" || remote.Url == "" {
+			return errors.New("every [[source.git]] remote needs a name and url")
+		}
+
+		if names[remote.Name] {
+			return fmt.Errorf("duplicate [[source.git]] remote name %s", remote.Name)
+		}
+		names[remote.Name] = true
+
+		if remote.PasswordEnv != "" && os.Getenv(remote.PasswordEnv) == "" {
+			return fmt.Errorf("password_env %s for remote %s is not set", remote.PasswordEnv, remote.Name)
+		}
+
+		if remote.Ssh.User == "" {
+			remote.Ssh.User = "git"
+		}
+
+		if err := expandSshConfig(ProtocolSsh, &remote.Ssh); err != nil {
+			return err
+		}
 	}
 
-	if config.Path.LogDir == "" {
+	return nil
+}
+
+// expandPath will resolve relative and home paths, empty paths are given the default relative to the pwd
+func expandPath(dir, defaultDir string) (string, error) {
+	if dir == "" {
 		pwd, err := os.Getwd()
 		if err != nil {
-			return err
+			return "", err
 		}
 
-		config.Path.LogDir = path.Join(pwd, DefaultLogDir)
-	} else if strings.HasPrefix(config.Path.LogDir, "./") {
+		return path.Join(pwd, defaultDir), nil
+	} else if strings.HasPrefix(dir, "./") {
 		pwd, err := os.Getwd()
 		if err != nil {
-			return err
+			return "", err
 		}
 
-		config.Path.LogDir = path.Join(pwd, config.Path.LogDir[2:])
-	} else if strings.HasPrefix(config.Path.LogDir, "~") {
+		return path.Join(pwd, dir[2:]), nil
+	} else if strings.HasPrefix(dir, "~") {
 		home := os.Getenv("HOME")
 
-		config.Path.LogDir = path.Join(home, config.Path.LogDir[1:])
+		return path.Join(home, dir[1:]), nil
 	}
 
-	config.Aws.Vault = fmt.Sprintf("%s_%s", config.Aws.Vault, config.Path.date())
-
-	return nil
+	return dir, nil
 }
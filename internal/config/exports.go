@@ -0,0 +1,33 @@
+package config
+
+import (
+	"github.com/aceviralltd/github-backup/internal/source"
+)
+
+const ExportSizeFileName = "export_sizes.json"
+
+// ExportSizes records how much was downloaded by the release and actions exports of a repo, these are
+// not part of the listed repo size so the last known sizes are used when estimating the disk space
+type ExportSizes struct {
+	Releases int64 `json:",omitempty"`
+	Actions  int64 `json:",omitempty"`
+}
+
+// Total of every export
+func (s ExportSizes) Total() int64 {
+	return s.Releases + s.Actions
+}
+
+// LastExportSizes will load the export sizes recorded for the repo, repos that have not been exported
+// before give zero sizes
+func LastExportSizes(config *Config, repo *source.Repository) ExportSizes {
+	var sizes ExportSizes
+	readStateFile(config.Path.RepoStatePath(repo, ExportSizeFileName), &sizes)
+
+	return sizes
+}
+
+// RecordExportSizes will store the export sizes of the repo for the next run
+func RecordExportSizes(config *Config, repo *source.Repository, sizes ExportSizes) {
+	writeStateFile(config.Path.RepoStatePath(repo, ExportSizeFileName), sizes)
+}
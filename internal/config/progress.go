@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"sync"
 )
 
 const (
@@ -16,25 +17,44 @@ type ProgressEntry struct {
 	Downloaded bool
 	Archived   bool
 	Uploaded   bool
+	// category of the most recent failure and the number of clone attempts it took
+	Failure  string `json:",omitempty"`
+	Attempts int    `json:",omitempty"`
+	// archives uploaded so far, a failed upload only retries the archives missing from here
+	Archives []ArchiveRecord `json:",omitempty"`
 }
 
-var CurrentRunProgress map[string]*ProgressEntry
+var (
+	currentRunProgress map[string]*ProgressEntry
+
+	progressMux sync.Mutex
+)
+
+// RunProgress gives a copy of the progress of the repo in the current run, or the fallback if the repo
+// has no progress yet
+//
+// the copy is only stored again by UpdateProgress so it can be changed without locking
+func RunProgress(repoName string, fallback ProgressEntry) *ProgressEntry {
+	progressMux.Lock()
+	defer progressMux.Unlock()
+
+	if entry, ok := currentRunProgress[repoName]; ok {
+		progress := *entry
+		progress.Archives = append([]ArchiveRecord(nil), entry.Archives...)
+		return &progress
+	}
+
+	return &fallback
+}
 
 // UpdateProgress will store the run progress to file to allow for resuming failed runs
 func UpdateProgress(config *Config, repoName string, progress ProgressEntry) {
-	if entry, ok := CurrentRunProgress[repoName]; ok {
-		entry.Downloaded = progress.Downloaded
-		entry.Archived = progress.Archived
-		entry.Uploaded = progress.Uploaded
-	} else {
-		CurrentRunProgress[repoName] = &ProgressEntry{
-			Downloaded: progress.Downloaded,
-			Archived:   progress.Archived,
-			Uploaded:   progress.Uploaded,
-		}
-	}
+	progressMux.Lock()
+	defer progressMux.Unlock()
 
-	data, err := json.Marshal(CurrentRunProgress)
+	currentRunProgress[repoName] = &progress
+
+	data, err := json.Marshal(currentRunProgress)
 	if err != nil {
 		log.Println("Failed to update progress")
 		return
@@ -46,8 +66,11 @@ func UpdateProgress(config *Config, repoName string, progress ProgressEntry) {
 
 // InitProgress will resume progress state from file (if appropriate)
 func InitProgress(config *Config) {
+	progressMux.Lock()
+	defer progressMux.Unlock()
+
 	progressFile := path.Join(config.Path.DownloadPath(), ProgressFileName)
-	CurrentRunProgress = make(map[string]*ProgressEntry)
+	currentRunProgress = make(map[string]*ProgressEntry)
 
 	if _, err := os.Stat(progressFile); err != nil {
 		return
@@ -55,6 +78,6 @@ func InitProgress(config *Config) {
 
 	data, err := ioutil.ReadFile(progressFile)
 	if err == nil {
-		_ = json.Unmarshal(data, &CurrentRunProgress)
+		_ = json.Unmarshal(data, &currentRunProgress)
 	}
 }
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestProgressConcurrentUpdates(t *testing.T) {
+	cfg := &Config{}
+	cfg.Path.RootDir = t.TempDir()
+	cfg.Path.ForceDate = "2021-06-01"
+
+	if err := os.MkdirAll(cfg.Path.DownloadPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	InitProgress(cfg)
+
+	// the repo workers and the archive and glacier workers all update progress at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("org/repo-%d", worker)
+			for attempt := 0; attempt < 20; attempt++ {
+				progress := RunProgress(name, ProgressEntry{})
+				progress.Attempts++
+				UpdateProgress(cfg, name, *progress)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// changes to a copy are only kept once they are stored again
+	progress := RunProgress("org/repo-0", ProgressEntry{})
+	progress.Uploaded = true
+
+	if RunProgress("org/repo-0", ProgressEntry{}).Uploaded {
+		t.Error("expected the stored progress to be unchanged until it is updated")
+	}
+
+	// the progress file is read back when a failed run is resumed
+	InitProgress(cfg)
+
+	for i := 0; i < 8; i++ {
+		if attempts := RunProgress(fmt.Sprintf("org/repo-%d", i), ProgressEntry{}).Attempts; attempts != 20 {
+			t.Errorf("expected 20 attempts for repo %d, got %d", i, attempts)
+		}
+	}
+}
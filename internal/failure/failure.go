@@ -0,0 +1,173 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitHttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/google/go-github/v34/github"
+)
+
+// Category groups failures by what an operator needs to do about them
+type Category string
+
+const (
+	None Category = ""
+	// the clone did not finish within its timeout, most likely a stalled transfer
+	Timeout Category = "timeout"
+	// connection level failures between us and the host
+	Network Category = "network"
+	// the host responded with a 5xx, an outage on their side
+	Server Category = "server"
+	// the host is throttling us
+	RateLimit Category = "rate_limit"
+	// credentials were rejected or no longer have access to the repo
+	Auth Category = "auth"
+	// the repo has been deleted or renamed (or access was lost and the host hides it)
+	NotFound Category = "not_found"
+	// we ran out of space locally
+	Disk    Category = "disk"
+	Unknown Category = "unknown"
+)
+
+// message fragments from the git cli and ssh, checked in order so the more specific ones come first
+var messageCategories = []struct {
+	fragment string
+	category Category
+}{
+	{"authentication failed", Auth},
+	{"could not read username", Auth},
+	{"could not read password", Auth},
+	{"permission denied", Auth},
+	{"unable to authenticate", Auth},
+	{"host key verification failed", Auth},
+	{"knownhosts", Auth},
+	{"repository not found", NotFound},
+	{"does not appear to be a git repository", NotFound},
+	{"no space left on device", Disk},
+	// glacier reports throttling as a 400 with a ThrottlingException code
+	{"throttl", RateLimit},
+	{"timed out", Timeout},
+	{"could not resolve host", Network},
+	{"connection refused", Network},
+	{"connection reset", Network},
+	{"early eof", Network},
+	{"hung up unexpectedly", Network},
+	{"broken pipe", Network},
+	{"tls handshake", Network},
+	{"internal server error", Server},
+	{"bad gateway", Server},
+	{"service unavailable", Server},
+	{"gateway timeout", Server},
+}
+
+// Retryable checks if a failure in the category is likely to go away on its own
+func (c Category) Retryable() bool {
+	switch c {
+	case Timeout, Network, Server, RateLimit:
+		return true
+	}
+
+	return false
+}
+
+// Classify works out the category of the error returned from a clone, export or upload
+func Classify(err error) Category {
+	if err == nil {
+		return None
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return Timeout
+	case errors.Is(err, syscall.ENOSPC):
+		return Disk
+	case errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod):
+		return Auth
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		return NotFound
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return Network
+	}
+
+	// a status that doesn't map onto a category (the likes of a 400) can still be matched by its message
+	if category := statusCategory(httpStatus(err)); category != Unknown {
+		return category
+	}
+
+	var rateLimitErr *github.RateLimitError
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &rateLimitErr) || errors.As(err, &abuseErr) {
+		return RateLimit
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return Timeout
+		}
+
+		return Network
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, match := range messageCategories {
+		if strings.Contains(message, match.fragment) {
+			return match.category
+		}
+	}
+
+	return Unknown
+}
+
+// httpStatus will find the status code of a failed api or git http response (if there is one)
+func httpStatus(err error) int {
+	var apiErr *github.ErrorResponse
+	if errors.As(err, &apiErr) && apiErr.Response != nil {
+		return apiErr.Response.StatusCode
+	}
+
+	// aws sdk errors carry the status of the failed request
+	var awsErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &awsErr) {
+		return awsErr.HTTPStatusCode()
+	}
+
+	// go-git does not unwrap its unexpected errors
+	var unexpectedErr *plumbing.UnexpectedError
+	if errors.As(err, &unexpectedErr) {
+		var gitErr *gitHttp.Err
+		if errors.As(unexpectedErr.Err, &gitErr) && gitErr.Response != nil {
+			return gitErr.Response.StatusCode
+		}
+	}
+
+	return 0
+}
+
+// statusCategory maps an http error status onto a category, unknown if there is no status
+func statusCategory(statusCode int) Category {
+	switch {
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return Auth
+	case statusCode == http.StatusNotFound, statusCode == http.StatusGone:
+		return NotFound
+	case statusCode == http.StatusTooManyRequests:
+		return RateLimit
+	case statusCode == http.StatusRequestTimeout:
+		return Timeout
+	case statusCode >= http.StatusInternalServerError:
+		return Server
+	}
+
+	return Unknown
+}
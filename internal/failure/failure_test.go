@@ -0,0 +1,52 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+)
+
+// statusError stands in for the aws sdk response errors
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e statusError) Error() string {
+	return e.message
+}
+
+func (e statusError) HTTPStatusCode() int {
+	return e.status
+}
+
+func TestClassify(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		expected Category
+	}{
+		"nil":         {nil, None},
+		"deadline":    {fmt.Errorf("clone: %w", context.DeadlineExceeded), Timeout},
+		"disk":        {fmt.Errorf("write: %w", syscall.ENOSPC), Disk},
+		"aws auth":    {fmt.Errorf("upload: %w", statusError{http.StatusForbidden, "InvalidSignatureException"}), Auth},
+		"aws vault":   {statusError{http.StatusNotFound, "ResourceNotFoundException: vault not found"}, NotFound},
+		"aws server":  {statusError{http.StatusServiceUnavailable, "ServiceUnavailableException"}, Server},
+		"aws timeout": {statusError{http.StatusRequestTimeout, "RequestTimeoutException"}, Timeout},
+		"aws throttled": {
+			statusError{http.StatusBadRequest, "ThrottlingException: Rate exceeded"},
+			RateLimit,
+		},
+		"aws bad request": {statusError{http.StatusBadRequest, "InvalidParameterValueException"}, Unknown},
+		"git cli":         {errors.New("fatal: Authentication failed for 'https://example.com/repo.git'"), Auth},
+		"unknown":         {errors.New("something went wrong"), Unknown},
+	}
+
+	for name, test := range tests {
+		if actual := Classify(test.err); actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", name, test.expected, actual)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io/fs"
 	"math"
 	"os"
+	"sync"
 
 	"github.com/aceviralltd/github-backup/internal/config"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -25,6 +26,13 @@ var MultipartChunkSize int64 = 134217728
 
 var awsGlacierClient *glacier.Client
 
+// the part buffer used by StreamToGlacier, it is allocated once and reused for every archive so streaming
+// never holds more than a single part (MultipartChunkSize) in memory
+var (
+	streamPart []byte
+	streamMux  sync.Mutex
+)
+
 // GlacierClient will setup the config and create a client connection for aws glacier
 func GlacierClient(ctx context.Context, cfg *config.Config) (*glacier.Client, error) {
 	if awsGlacierClient == nil {
@@ -42,7 +50,7 @@ func GlacierClient(ctx context.Context, cfg *config.Config) (*glacier.Client, er
 }
 
 // CreateGlacierVault will setup a brand new vault for this run
-func CreateGlacierVault(cfg *config.Config) error {
+func CreateGlacierVault(cfg *config.Config, vault string) error {
 	ctx := context.Background()
 
 	client, err := GlacierClient(ctx, cfg)
@@ -52,14 +60,14 @@ func CreateGlacierVault(cfg *config.Config) error {
 
 	_, err = client.CreateVault(ctx, &glacier.CreateVaultInput{
 		AccountId: &cfg.Aws.AccountId,
-		VaultName: &cfg.Aws.Vault,
+		VaultName: &vault,
 	})
 
 	return err
 }
 
-// Upload the archive of the git dir to glacier
-func UploadToGlacier(cfg *config.Config, file *os.File, description string) (string, error) {
+// Upload the archive of the git dir to the given glacier vault
+func UploadToGlacier(cfg *config.Config, vault string, file *os.File, description string) (string, error) {
 	ctx := context.Background()
 
 	client, err := GlacierClient(ctx, cfg)
@@ -73,14 +81,14 @@ func UploadToGlacier(cfg *config.Config, file *os.File, description string) (str
 	}
 
 	if stat.Size() > MultipartChunkSize {
-		return multiPartUpload(cfg, file, stat, client, description)
+		return multiPartUpload(cfg, vault, file, stat, client, description)
 	}
 
 	response, err := client.UploadArchive(
 		ctx,
 		&glacier.UploadArchiveInput{
 			AccountId:          &cfg.Aws.AccountId,
-			VaultName:          &cfg.Aws.Vault,
+			VaultName:          &vault,
 			ArchiveDescription: &description,
 			Body:               file,
 		},
@@ -93,8 +101,145 @@ func UploadToGlacier(cfg *config.Config, file *os.File, description string) (str
 	return *response.ArchiveId, err
 }
 
-// InitArchiveDownload will start the process of downloading an archive to the local machine
-func InitArchiveDownload(cfg *config.Config, archiveId string) (string, error) {
+// StreamToGlacier will upload the archive written by the given func as it is produced, parts are
+// uploaded as soon as they fill and nothing is staged on disk
+//
+// archives that fit in a single part are sent as a normal upload, glacier needs to know the size of
+// these up front so they are buffered in full before being sent. Both cases share the one part buffer,
+// so streaming uses MultipartChunkSize (128MB) of memory however many archives are sent, uploads are
+// made one at a time to keep it that way
+func StreamToGlacier(cfg *config.Config, vault, description string, archive func(io.Writer) error) (string, error) {
+	streamMux.Lock()
+	defer streamMux.Unlock()
+
+	ctx := context.Background()
+
+	client, err := GlacierClient(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(archive(writer))
+	}()
+
+	// stops the archive func writing into the pipe if the upload gives up part way through
+	defer reader.Close()
+
+	if int64(len(streamPart)) != MultipartChunkSize {
+		streamPart = make([]byte, MultipartChunkSize)
+	}
+
+	part := streamPart
+	size, err := io.ReadFull(reader, part)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		response, err := client.UploadArchive(ctx, &glacier.UploadArchiveInput{
+			AccountId:          &cfg.Aws.AccountId,
+			VaultName:          &vault,
+			ArchiveDescription: &description,
+			Body:               bytes.NewReader(part[:size]),
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		return *response.ArchiveId, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return streamMultipart(ctx, cfg, client, vault, description, reader, part)
+}
+
+// streamMultipart will upload the first (already full) part followed by the rest of the archive as it is
+// read, the tree hash of the whole archive is built up alongside the parts
+func streamMultipart(
+	ctx context.Context,
+	cfg *config.Config,
+	client *glacier.Client,
+	vault string,
+	description string,
+	reader io.Reader,
+	part []byte,
+) (
+	string,
+	error,
+) {
+	mpResponse, err := client.InitiateMultipartUpload(ctx, &glacier.InitiateMultipartUploadInput{
+		AccountId:          &cfg.Aws.AccountId,
+		VaultName:          &vault,
+		ArchiveDescription: &description,
+		PartSize:           &MultipartChunkSizeHeader,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	archiveHash := newTreeHash()
+	var start int64
+
+	for size := len(part); size > 0; {
+		data := part[:size]
+		archiveHash.Write(data)
+
+		partHash := newTreeHash()
+		partHash.Write(data)
+
+		_, err = client.UploadMultipartPart(ctx, &glacier.UploadMultipartPartInput{
+			AccountId: &cfg.Aws.AccountId,
+			VaultName: &vault,
+			UploadId:  mpResponse.UploadId,
+			Range:     aws.String(fmt.Sprintf("bytes %d-%d/*", start, start+int64(size)-1)),
+			Checksum:  aws.String(partHash.Sum()),
+			Body:      bytes.NewReader(data),
+		})
+
+		if err != nil {
+			break
+		}
+
+		start += int64(size)
+
+		// the last part is the only one allowed to be short
+		size, err = io.ReadFull(reader, part)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		_, _ = client.AbortMultipartUpload(ctx, &glacier.AbortMultipartUploadInput{
+			AccountId: &cfg.Aws.AccountId,
+			VaultName: &vault,
+			UploadId:  mpResponse.UploadId,
+		})
+
+		return "", err
+	}
+
+	complete, err := client.CompleteMultipartUpload(ctx, &glacier.CompleteMultipartUploadInput{
+		AccountId:   &cfg.Aws.AccountId,
+		VaultName:   &vault,
+		UploadId:    mpResponse.UploadId,
+		ArchiveSize: aws.String(fmt.Sprint(start)),
+		Checksum:    aws.String(archiveHash.Sum()),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return *complete.ArchiveId, nil
+}
+
+// InitArchiveDownload will start the process of downloading an archive from the vault to the local machine
+func InitArchiveDownload(cfg *config.Config, vault, archiveId string) (string, error) {
 	ctx := context.Background()
 
 	client, err := GlacierClient(ctx, cfg)
@@ -104,7 +249,7 @@ func InitArchiveDownload(cfg *config.Config, archiveId string) (string, error) {
 
 	job, err := client.InitiateJob(ctx, &glacier.InitiateJobInput{
 		AccountId: aws.String(cfg.Aws.AccountId),
-		VaultName: aws.String(cfg.Aws.Vault),
+		VaultName: aws.String(vault),
 		JobParameters: &types.JobParameters{
 			ArchiveId: &archiveId,
 			Type:      aws.String("archive-retrieval"),
@@ -118,11 +263,11 @@ func InitArchiveDownload(cfg *config.Config, archiveId string) (string, error) {
 	return *job.JobId, nil
 }
 
-// ListCurrentJobs on aws glacier
-func ListCurrentJobs(ctx context.Context, cfg *config.Config, client *glacier.Client) *glacier.ListJobsOutput {
+// ListCurrentJobs for the vault on aws glacier
+func ListCurrentJobs(ctx context.Context, cfg *config.Config, vault string, client *glacier.Client) *glacier.ListJobsOutput {
 	output, err := client.ListJobs(ctx, &glacier.ListJobsInput{
 		AccountId: aws.String(cfg.Aws.AccountId),
-		VaultName: aws.String(cfg.Aws.Vault),
+		VaultName: aws.String(vault),
 	})
 
 	if err != nil {
@@ -135,6 +280,7 @@ func ListCurrentJobs(ctx context.Context, cfg *config.Config, client *glacier.Cl
 // multiPartUpload will send the file in 100MB chunck to glacier
 func multiPartUpload(
 	cfg *config.Config,
+	vault string,
 	file *os.File,
 	stat fs.FileInfo,
 	client *glacier.Client,
@@ -147,7 +293,7 @@ func multiPartUpload(
 
 	mpResponse, err := client.InitiateMultipartUpload(ctx, &glacier.InitiateMultipartUploadInput{
 		AccountId:          &cfg.Aws.AccountId,
-		VaultName:          &cfg.Aws.Vault,
+		VaultName:          &vault,
 		ArchiveDescription: &description,
 		PartSize:           &MultipartChunkSizeHeader,
 	})
@@ -163,14 +309,14 @@ func multiPartUpload(
 		end := int64(math.Min(float64(start+MultipartChunkSize), float64(stat.Size())))
 
 		data := make([]byte, int(end-start))
-		if _, err := file.Read(data); err != nil {
+		if _, err := io.ReadFull(file, data); err != nil {
 			chunkErr = err
 			break
 		}
 
 		_, chunkErr = client.UploadMultipartPart(ctx, &glacier.UploadMultipartPartInput{
 			AccountId: &cfg.Aws.AccountId,
-			VaultName: &cfg.Aws.Vault,
+			VaultName: &vault,
 			UploadId:  mpResponse.UploadId,
 			Range:     aws.String(fmt.Sprintf("bytes %d-%d/*", start, end-1)),
 			Body:      bytes.NewReader(data),
@@ -184,7 +330,7 @@ func multiPartUpload(
 	if chunkErr != nil {
 		_, _ = client.AbortMultipartUpload(ctx, &glacier.AbortMultipartUploadInput{
 			AccountId: &cfg.Aws.AccountId,
-			VaultName: &cfg.Aws.Vault,
+			VaultName: &vault,
 			UploadId:  mpResponse.UploadId,
 		})
 
@@ -192,9 +338,9 @@ func multiPartUpload(
 	}
 
 	_, _ = file.Seek(0, io.SeekStart)
-	_, err = client.CompleteMultipartUpload(ctx, &glacier.CompleteMultipartUploadInput{
+	complete, err := client.CompleteMultipartUpload(ctx, &glacier.CompleteMultipartUploadInput{
 		AccountId:   &cfg.Aws.AccountId,
-		VaultName:   &cfg.Aws.Vault,
+		VaultName:   &vault,
 		UploadId:    mpResponse.UploadId,
 		ArchiveSize: aws.String(fmt.Sprint(stat.Size())),
 		Checksum:    aws.String(hex.EncodeToString(glacierV1.ComputeHashes(file).TreeHash)),
@@ -204,7 +350,7 @@ func multiPartUpload(
 		return "", err
 	}
 
-	return *mpResponse.UploadId, nil
+	return *complete.ArchiveId, nil
 }
 
 // awsSession will create a new aws session for the provided credentials
@@ -0,0 +1,73 @@
+package aws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// glacier hashes archives in 1MB blocks
+const treeHashBlockSize = 1024 * 1024
+
+// treeHash computes the glacier sha256 tree hash of everything written to it as it is written, only the
+// hash of each block is kept so it can cover an archive of any size without holding onto it
+type treeHash struct {
+	block  hash.Hash
+	filled int
+	leaves [][]byte
+}
+
+func newTreeHash() *treeHash {
+	return &treeHash{block: sha256.New()}
+}
+
+// Write adds the data to the hash, it never fails
+func (t *treeHash) Write(data []byte) (int, error) {
+	written := len(data)
+
+	for len(data) > 0 {
+		n := treeHashBlockSize - t.filled
+		if n > len(data) {
+			n = len(data)
+		}
+
+		t.block.Write(data[:n])
+		t.filled += n
+		data = data[n:]
+
+		if t.filled == treeHashBlockSize {
+			t.leaves = append(t.leaves, t.block.Sum(nil))
+			t.block.Reset()
+			t.filled = 0
+		}
+	}
+
+	return written, nil
+}
+
+// Sum combines the block hashes into the hex encoded tree hash of everything written so far
+func (t *treeHash) Sum() string {
+	level := append([][]byte{}, t.leaves...)
+	if t.filled > 0 || len(level) == 0 {
+		level = append(level, t.block.Sum(nil))
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+
+		for i := 0; i < len(level); i += 2 {
+			// an odd hash out is carried up to the next level as is
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+
+			pair := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, pair[:])
+		}
+
+		level = next
+	}
+
+	return hex.EncodeToString(level[0])
+}
@@ -0,0 +1,175 @@
+package bundle
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+)
+
+// header is the list of prerequisites and refs at the start of a bundle
+type header struct {
+	Prerequisites []plumbing.Hash
+	Refs          []*plumbing.Reference
+}
+
+// Apply will unpack the bundle into the bare repo at repoPath (creating it if needed) and update its
+// branches and tags to match the bundle, refs that are not in the bundle are removed
+//
+// incremental bundles can only be applied on top of the bundles before them in the chain
+func Apply(repoPath, bundlePath string) error {
+	repository, err := git.PlainOpen(repoPath)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repository, err = git.PlainInit(repoPath, true)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	bundleHeader, err := readHeader(reader)
+	if err != nil {
+		return err
+	}
+
+	for _, prerequisite := range bundleHeader.Prerequisites {
+		if _, err = repository.CommitObject(prerequisite); err != nil {
+			return fmt.Errorf("missing prerequisite %s, the earlier bundles in the chain need applying first", prerequisite)
+		}
+	}
+
+	if err = packfile.UpdateObjectStorage(repository.Storer, reader); err != nil {
+		return err
+	}
+
+	return updateRefs(repository, bundleHeader.Refs)
+}
+
+// readHeader parses the bundle header leaving the reader at the start of the packfile
+func readHeader(reader *bufio.Reader) (*header, error) {
+	signature, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if signature != Signature {
+		return nil, fmt.Errorf("unsupported bundle format %q", strings.TrimSpace(signature))
+	}
+
+	bundleHeader := &header{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return bundleHeader, nil
+		}
+
+		// prerequisites can be followed by a comment, refs are always followed by their name
+		if strings.HasPrefix(line, "-") {
+			bundleHeader.Prerequisites = append(bundleHeader.Prerequisites, plumbing.NewHash(strings.Fields(line[1:])[0]))
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid bundle ref %q", line)
+		}
+
+		bundleHeader.Refs = append(bundleHeader.Refs, plumbing.NewHashReference(plumbing.ReferenceName(parts[1]), plumbing.NewHash(parts[0])))
+	}
+}
+
+// updateRefs makes the refs of the repo match the bundle
+func updateRefs(repository *git.Repository, refs []*plumbing.Reference) error {
+	var head *plumbing.Reference
+	existing := make(map[plumbing.ReferenceName]bool)
+
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD {
+			head = ref
+			continue
+		}
+
+		existing[ref.Name()] = true
+		if err := repository.Storer.SetReference(ref); err != nil {
+			return err
+		}
+	}
+
+	iter, err := repository.References()
+	if err != nil {
+		return err
+	}
+
+	var stale []plumbing.ReferenceName
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if (ref.Name().IsBranch() || ref.Name().IsTag()) && !existing[ref.Name()] {
+			stale = append(stale, ref.Name())
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range stale {
+		if err = repository.Storer.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+
+	if head == nil {
+		return nil
+	}
+
+	// bundles only record the hash of HEAD so the branch it points at is found by matching it, when
+	// several branches match the current HEAD is kept or the usual default branches are preferred
+	var matches []plumbing.ReferenceName
+	for _, ref := range refs {
+		if ref.Name().IsBranch() && ref.Hash() == head.Hash() {
+			matches = append(matches, ref.Name())
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil
+	}
+
+	return repository.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, headTarget(repository, matches)))
+}
+
+// headTarget picks the branch for HEAD out of those at the same commit
+func headTarget(repository *git.Repository, matches []plumbing.ReferenceName) plumbing.ReferenceName {
+	preferred := []plumbing.ReferenceName{plumbing.Master, plumbing.NewBranchReferenceName("main")}
+	if current, err := repository.Storer.Reference(plumbing.HEAD); err == nil {
+		preferred = append([]plumbing.ReferenceName{current.Target()}, preferred...)
+	}
+
+	for _, name := range preferred {
+		for _, match := range matches {
+			if match == name {
+				return match
+			}
+		}
+	}
+
+	return matches[0]
+}
@@ -0,0 +1,206 @@
+package bundle
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+)
+
+const (
+	Signature = "# v2 git bundle\n"
+
+	// number of objects the packfile encoder looks back over when searching for delta bases
+	PackWindow = 10
+)
+
+// ErrNoRefs is returned for repos that have nothing to bundle, either because they have no refs or
+// because every ref still points at the basis of an incremental bundle
+var ErrNoRefs = errors.New("repo has no refs to bundle")
+
+// Create will write every ref in the repo (along with HEAD) and all the objects reachable from them
+// to a bundle at the given path, the same as git bundle create --all
+//
+// the refs that were written are returned
+func Create(repoPath, bundlePath string) ([]*plumbing.Reference, error) {
+	refs, _, err := CreateIncremental(repoPath, bundlePath, nil)
+	return refs, err
+}
+
+// CreateIncremental works the same as Create but leaves out every object reachable from the basis
+// (the ref tips of a previous bundle), these become prerequisites of the bundle
+//
+// basis commits that are no longer in the repo (after a force push) are dropped, this only makes
+// the bundle larger as their objects are included instead, a repo that has not changed since the
+// basis gives ErrNoRefs
+func CreateIncremental(repoPath, bundlePath string, basis []plumbing.Hash) ([]*plumbing.Reference, []plumbing.Hash, error) {
+	repository, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refs, err := Tips(repository)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(refs) == 0 {
+		return nil, nil, ErrNoRefs
+	}
+
+	var tips []plumbing.Hash
+	for _, ref := range refs {
+		tips = append(tips, ref.Hash())
+	}
+
+	// everything reachable from the basis is in the earlier bundles of the chain
+	if sameTips(tips, basis) {
+		return nil, nil, ErrNoRefs
+	}
+
+	prerequisites := prerequisiteCommits(repository, basis)
+
+	objects, err := revlist.Objects(repository.Storer, tips, prerequisites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Create(bundlePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	if _, err = writer.WriteString(Signature); err != nil {
+		return nil, nil, err
+	}
+
+	for _, prerequisite := range prerequisites {
+		if _, err = fmt.Fprintf(writer, "-%s\n", prerequisite); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, ref := range refs {
+		if _, err = fmt.Fprintf(writer, "%s %s\n", ref.Hash(), ref.Name()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if _, err = writer.WriteString("\n"); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = packfile.NewEncoder(writer, repository.Storer, false).Encode(objects, PackWindow); err != nil {
+		return nil, nil, err
+	}
+
+	if err = writer.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	return refs, prerequisites, file.Close()
+}
+
+// CreateWithGit will create the bundle using the git cli
+func CreateWithGit(gitBin, repoPath, bundlePath string) error {
+	cmd := exec.Command(gitBin, "bundle", "create", bundlePath, "--all")
+	cmd.Dir = repoPath
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git bundle failed: %s: %w", output, err)
+	}
+
+	return nil
+}
+
+// Tips lists every ref in the repo resolved to the hash it points at, HEAD is included so that
+// cloning from the bundle checks out the default branch
+func Tips(repository *git.Repository) ([]*plumbing.Reference, error) {
+	var refs []*plumbing.Reference
+
+	iter, err := repository.References()
+	if err != nil {
+		return nil, err
+	}
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && ref.Name() != plumbing.HEAD {
+			refs = append(refs, ref)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Name() < refs[j].Name()
+	})
+
+	// an unborn HEAD (the default branch has no commits) is just left out
+	if head, err := repository.Head(); err == nil {
+		refs = append([]*plumbing.Reference{plumbing.NewHashReference(plumbing.HEAD, head.Hash())}, refs...)
+	}
+
+	return refs, nil
+}
+
+// sameTips checks if the ref tips are exactly the basis, a moved or deleted ref still needs a bundle
+// even when it adds no new commits
+func sameTips(tips, basis []plumbing.Hash) bool {
+	if basis == nil || len(tips) != len(basis) {
+		return false
+	}
+
+	counts := make(map[plumbing.Hash]int)
+	for _, hash := range basis {
+		counts[hash]++
+	}
+
+	for _, hash := range tips {
+		if counts[hash] == 0 {
+			return false
+		}
+
+		counts[hash]--
+	}
+
+	return true
+}
+
+// prerequisiteCommits peels the basis down to the distinct commits that still exist in the repo
+func prerequisiteCommits(repository *git.Repository, basis []plumbing.Hash) []plumbing.Hash {
+	var commits []plumbing.Hash
+	seen := make(map[plumbing.Hash]bool)
+
+	for _, hash := range basis {
+		if tag, err := repository.TagObject(hash); err == nil {
+			commit, err := tag.Commit()
+			if err != nil {
+				continue
+			}
+
+			hash = commit.Hash
+		}
+
+		if _, err := repository.CommitObject(hash); err != nil || seen[hash] {
+			continue
+		}
+
+		seen[hash] = true
+		commits = append(commits, hash)
+	}
+
+	return commits
+}
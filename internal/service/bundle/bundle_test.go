@@ -0,0 +1,211 @@
+package bundle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func testSignature() *object.Signature {
+	return &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}
+}
+
+// testRepo creates a repo on disk with a commit on master, a feature branch and an annotated tag
+func testRepo(t *testing.T) (*git.Repository, string) {
+	dir := t.TempDir()
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initial := commitFile(t, repo, dir, "README.md")
+
+	if _, err = repo.CreateTag("v1.0.0", initial, &git.CreateTagOptions{Tagger: testSignature(), Message: "release"}); err != nil {
+		t.Fatal(err)
+	}
+
+	feature := plumbing.NewHashReference(plumbing.NewBranchReferenceName("feature"), initial)
+	if err = repo.Storer.SetReference(feature); err != nil {
+		t.Fatal(err)
+	}
+
+	return repo, dir
+}
+
+// commitFile writes a new file to the worktree and commits it to the checked out branch
+func commitFile(t *testing.T, repo *git.Repository, dir, name string) plumbing.Hash {
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(name+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = worktree.Add(name); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := worktree.Commit("add "+name, &git.CommitOptions{Author: testSignature()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+// refMap lists the refs of the repo by name, HEAD is given as the ref it points at
+func refMap(t *testing.T, repoPath string) map[string]string {
+	repo, err := git.PlainOpen(repoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := make(map[string]string)
+
+	iter, err := repo.References()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.SymbolicReference {
+			refs[ref.Name().String()] = ref.Target().String()
+		} else {
+			refs[ref.Name().String()] = ref.Hash().String()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return refs
+}
+
+func assertSameRefs(t *testing.T, expectedPath, actualPath string) {
+	expected := refMap(t, expectedPath)
+	actual := refMap(t, actualPath)
+
+	if fmt.Sprint(expected) != fmt.Sprint(actual) {
+		t.Errorf("expected refs %v, got %v", expected, actual)
+	}
+
+	repo, err := git.PlainOpen(actualPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every ref has to be readable, not just present
+	for name, hash := range actual {
+		if name == plumbing.HEAD.String() {
+			continue
+		}
+
+		if _, err = repo.Object(plumbing.AnyObject, plumbing.NewHash(hash)); err != nil {
+			t.Errorf("object for %s is missing: %s", name, err)
+		}
+	}
+}
+
+func TestCreateAndApply(t *testing.T) {
+	_, repoPath := testRepo(t)
+	bundlePath := path.Join(t.TempDir(), "repo.bundle")
+
+	refs, err := Create(repoPath, bundlePath)
+	if err != nil {
+		t.Fatalf("bundle failed: %s", err)
+	}
+
+	// HEAD, master, feature and the tag
+	if len(refs) != 4 || refs[0].Name() != plumbing.HEAD {
+		t.Errorf("expected HEAD followed by 3 refs, got %v", refs)
+	}
+
+	restorePath := path.Join(t.TempDir(), "restored.git")
+	if err = Apply(restorePath, bundlePath); err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+
+	assertSameRefs(t, repoPath, restorePath)
+}
+
+func TestCreateEmptyRepo(t *testing.T) {
+	repoPath := t.TempDir()
+	if _, err := git.PlainInit(repoPath, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Create(repoPath, path.Join(t.TempDir(), "empty.bundle")); err != ErrNoRefs {
+		t.Errorf("expected ErrNoRefs for a repo without commits, got %v", err)
+	}
+}
+
+func TestCreateVerifiesWithGit(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	_, repoPath := testRepo(t)
+	bundlePath := path.Join(t.TempDir(), "repo.bundle")
+
+	if _, err = Create(repoPath, bundlePath); err != nil {
+		t.Fatalf("bundle failed: %s", err)
+	}
+
+	// verify needs a repo to check the prerequisites against even when there are none
+	verifyDir := t.TempDir()
+	if output, err := exec.Command(gitBin, "init", "--bare", verifyDir).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %s", output)
+	}
+
+	cmd := exec.Command(gitBin, "bundle", "verify", bundlePath)
+	cmd.Dir = verifyDir
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("git bundle verify failed: %s", output)
+	}
+
+	clonePath := path.Join(t.TempDir(), "clone.git")
+	if output, err := exec.Command(gitBin, "clone", "--mirror", bundlePath, clonePath).CombinedOutput(); err != nil {
+		t.Fatalf("git clone from the bundle failed: %s", output)
+	}
+
+	cloned := refMap(t, clonePath)
+	for name, hash := range refMap(t, repoPath) {
+		if name != plumbing.HEAD.String() && cloned[name] != hash {
+			t.Errorf("expected %s at %s in the clone, got %q", name, hash, cloned[name])
+		}
+	}
+}
+
+func TestApplyMissingPrerequisite(t *testing.T) {
+	repo, repoPath := testRepo(t)
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitFile(t, repo, repoPath, "CHANGELOG.md")
+
+	bundlePath := path.Join(t.TempDir(), "incremental.bundle")
+	if _, _, err = CreateIncremental(repoPath, bundlePath, []plumbing.Hash{head.Hash()}); err != nil {
+		t.Fatalf("bundle failed: %s", err)
+	}
+
+	if err = Apply(path.Join(t.TempDir(), "restored.git"), bundlePath); err == nil {
+		t.Error("expected applying an incremental bundle to an empty repo to fail")
+	}
+}
@@ -0,0 +1,116 @@
+package bundle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	// ChainVersion should be bumped whenever the structure of Chain changes
+	ChainVersion = 1
+
+	ChainFile        = "bundles.json"
+	PendingChainFile = "bundles.pending.json"
+)
+
+// Chain is the manifest of a full bundle and the incremental bundles built on top of it, restoring
+// means applying every entry in order
+type Chain struct {
+	Version int
+	Entries []*ChainEntry
+}
+
+// ChainEntry describes a single bundle in the chain and where its archive was uploaded
+type ChainEntry struct {
+	File          string
+	CreatedAt     time.Time
+	Full          bool
+	Prerequisites []string
+	Refs          map[string]string
+	Vault         string
+	Description   string
+	// only known once the archive has been uploaded
+	ArchiveId string
+}
+
+// LoadChain reads the chain manifest at the given path, a missing manifest gives an empty chain
+func LoadChain(chainPath string) (*Chain, error) {
+	chain := &Chain{Version: ChainVersion}
+
+	data, err := ioutil.ReadFile(chainPath)
+	if os.IsNotExist(err) {
+		return chain, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return chain, json.Unmarshal(data, chain)
+}
+
+// Save writes the chain manifest to the given path
+func (c *Chain) Save(chainPath string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(path.Dir(chainPath), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(chainPath, data, 0644)
+}
+
+// Tips gives the ref tips of the last bundle in the chain, these are the basis for the next one
+func (c *Chain) Tips() []plumbing.Hash {
+	if len(c.Entries) == 0 {
+		return nil
+	}
+
+	var tips []plumbing.Hash
+	for _, hash := range c.Entries[len(c.Entries)-1].Refs {
+		tips = append(tips, plumbing.NewHash(hash))
+	}
+
+	return tips
+}
+
+// Rollover will start the chain again once it holds the full bundle and maxIncremental incremental
+// bundles, so the next bundle is a full one, true is returned if the chain was reset
+func (c *Chain) Rollover(maxIncremental int) bool {
+	if len(c.Entries) <= maxIncremental {
+		return false
+	}
+
+	c.Version = ChainVersion
+	c.Entries = nil
+	return true
+}
+
+// Add will append a bundle to the chain
+func (c *Chain) Add(file, vault, description string, refs []*plumbing.Reference, prerequisites []plumbing.Hash) *ChainEntry {
+	entry := &ChainEntry{
+		File:        file,
+		CreatedAt:   time.Now(),
+		Full:        len(c.Entries) == 0,
+		Refs:        make(map[string]string),
+		Vault:       vault,
+		Description: description,
+	}
+
+	for _, ref := range refs {
+		entry.Refs[ref.Name().String()] = ref.Hash().String()
+	}
+
+	for _, prerequisite := range prerequisites {
+		entry.Prerequisites = append(entry.Prerequisites, prerequisite.String())
+	}
+
+	c.Entries = append(c.Entries, entry)
+	return entry
+}
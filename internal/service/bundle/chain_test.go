@@ -0,0 +1,163 @@
+package bundle
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// addBundle writes the next bundle of the chain for the repo and adds it to the chain
+func addBundle(t *testing.T, chain *Chain, repoPath, bundleDir, file string) *ChainEntry {
+	refs, prerequisites, err := CreateIncremental(repoPath, path.Join(bundleDir, file), chain.Tips())
+	if err != nil {
+		t.Fatalf("bundle %s failed: %s", file, err)
+	}
+
+	return chain.Add(file, "vault", "description", refs, prerequisites)
+}
+
+func TestIncrementalChainRestoresRefs(t *testing.T) {
+	repo, repoPath := testRepo(t)
+	bundleDir := t.TempDir()
+	chain := &Chain{Version: ChainVersion}
+
+	full := addBundle(t, chain, repoPath, bundleDir, "repo.1.bundle")
+	if !full.Full || len(full.Prerequisites) != 0 {
+		t.Errorf("expected the first bundle to be full, got %+v", full)
+	}
+
+	commitFile(t, repo, repoPath, "CHANGELOG.md")
+	first := addBundle(t, chain, repoPath, bundleDir, "repo.2.bundle")
+
+	// the second incremental moves master on and deletes a branch
+	commitFile(t, repo, repoPath, "LICENSE")
+	if err := repo.Storer.RemoveReference(plumbing.NewBranchReferenceName("feature")); err != nil {
+		t.Fatal(err)
+	}
+
+	second := addBundle(t, chain, repoPath, bundleDir, "repo.3.bundle")
+
+	for _, entry := range []*ChainEntry{first, second} {
+		if entry.Full || len(entry.Prerequisites) == 0 {
+			t.Errorf("expected %s to be incremental, got %+v", entry.File, entry)
+		}
+	}
+
+	// the manifest is what the restore reads so it goes through a save and load
+	chainPath := path.Join(bundleDir, ChainFile)
+	if err := chain.Save(chainPath); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadChain(chainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restorePath := path.Join(t.TempDir(), "restored.git")
+	for _, entry := range loaded.Entries {
+		if err = Apply(restorePath, path.Join(bundleDir, entry.File)); err != nil {
+			t.Fatalf("apply %s failed: %s", entry.File, err)
+		}
+	}
+
+	assertSameRefs(t, repoPath, restorePath)
+
+	if _, ok := refMap(t, restorePath)["refs/heads/feature"]; ok {
+		t.Error("expected the deleted branch to be removed by the last bundle")
+	}
+}
+
+func TestIncrementalVerifiesWithGit(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	repo, repoPath := testRepo(t)
+	bundleDir := t.TempDir()
+	chain := &Chain{Version: ChainVersion}
+
+	addBundle(t, chain, repoPath, bundleDir, "repo.1.bundle")
+	commitFile(t, repo, repoPath, "CHANGELOG.md")
+	addBundle(t, chain, repoPath, bundleDir, "repo.2.bundle")
+
+	// git checks the prerequisites of the incremental bundle against the repo it is run in
+	restorePath := path.Join(t.TempDir(), "restored.git")
+	if err = Apply(restorePath, path.Join(bundleDir, "repo.1.bundle")); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(gitBin, "bundle", "verify", path.Join(bundleDir, "repo.2.bundle"))
+	cmd.Dir = restorePath
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("git bundle verify failed: %s", output)
+	}
+}
+
+func TestCreateIncrementalUnchanged(t *testing.T) {
+	repo, repoPath := testRepo(t)
+	bundleDir := t.TempDir()
+	chain := &Chain{Version: ChainVersion}
+
+	addBundle(t, chain, repoPath, bundleDir, "repo.1.bundle")
+
+	bundlePath := path.Join(bundleDir, "repo.2.bundle")
+	if _, _, err := CreateIncremental(repoPath, bundlePath, chain.Tips()); err != ErrNoRefs {
+		t.Fatalf("expected ErrNoRefs for an unchanged repo, got %v", err)
+	}
+
+	if _, err := os.Stat(bundlePath); !os.IsNotExist(err) {
+		t.Error("expected no bundle to be written for an unchanged repo")
+	}
+
+	// a deleted ref adds no objects but still has to be bundled so the restore drops it
+	if err := repo.Storer.RemoveReference(plumbing.NewBranchReferenceName("feature")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := CreateIncremental(repoPath, bundlePath, chain.Tips()); err != nil {
+		t.Errorf("expected a bundle for the deleted ref, got %v", err)
+	}
+}
+
+func TestChainRollover(t *testing.T) {
+	repo, repoPath := testRepo(t)
+	bundleDir := t.TempDir()
+	chain := &Chain{Version: ChainVersion}
+
+	const maxIncremental = 2
+	for i, file := range []string{"repo.1.bundle", "repo.2.bundle", "repo.3.bundle"} {
+		if chain.Rollover(maxIncremental) {
+			t.Fatalf("expected no rollover before bundle %d", i+1)
+		}
+
+		commitFile(t, repo, repoPath, file+".txt")
+		addBundle(t, chain, repoPath, bundleDir, file)
+	}
+
+	if !chain.Rollover(maxIncremental) {
+		t.Fatal("expected a rollover once the full bundle has 2 incrementals")
+	}
+
+	if len(chain.Entries) != 0 || chain.Tips() != nil {
+		t.Fatalf("expected the chain to be empty after the rollover, got %d entries", len(chain.Entries))
+	}
+
+	entry := addBundle(t, chain, repoPath, bundleDir, "repo.4.bundle")
+	if !entry.Full || len(entry.Prerequisites) != 0 {
+		t.Errorf("expected a full bundle after the rollover, got %+v", entry)
+	}
+
+	// the new full bundle restores on its own
+	restorePath := path.Join(t.TempDir(), "restored.git")
+	if err := Apply(restorePath, path.Join(bundleDir, entry.File)); err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+
+	assertSameRefs(t, repoPath, restorePath)
+}
@@ -0,0 +1,141 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/service/lfs"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Options control how the repos of a source are cloned
+type Options struct {
+	// https or ssh
+	Protocol string
+	// https credentials, also used for lfs
+	Username string
+	Password string
+	Ssh      config.SshConfig
+	Wikis    bool
+	Lfs      bool
+}
+
+// Repo will clone a repo along with its lfs objects and wiki (if it has them) into the repo path
+func Repo(ctx context.Context, cfg *config.Config, repo *source.Repository, opts Options, logger *log.Logger) error {
+	// there is nothing to clone from a repo without any commits
+	if repo.Empty {
+		return nil
+	}
+
+	if err := Bare(ctx, cfg, repo.Name, repoCloneUrl(repo, opts), cfg.Path.RepoPath(repo), opts, logger); err != nil {
+		return err
+	}
+
+	if opts.Lfs {
+		if err := downloadLfsObjects(ctx, cfg, repo, opts, logger); err != nil {
+			return err
+		}
+	}
+
+	if opts.Wikis && repo.HasWiki {
+		return downloadWiki(ctx, cfg, repo, opts, logger)
+	}
+
+	// a mirrored wiki that has since been disabled would otherwise keep being archived
+	if cfg.Path.IsMirror(cfg.Path.WikiPath(repo)) {
+		os.RemoveAll(cfg.Path.WikiPath(repo))
+	}
+
+	return nil
+}
+
+// Bare will do a bare clone of the given url falling back to the git cli if needed
+//
+// when mirrors are enabled the persistent mirror is updated instead, otherwise anything left at the
+// destination by a previous attempt is removed first
+func Bare(ctx context.Context, cfg *config.Config, name, cloneUrl, destination string, opts Options, logger *log.Logger) error {
+	if cfg.Path.IsMirror(destination) {
+		return redact(syncMirror(ctx, cfg, name, cloneUrl, destination, opts, logger), opts)
+	}
+
+	if err := os.RemoveAll(destination); err != nil {
+		return err
+	}
+
+	auth, err := cloneAuth(cloneUrl, opts)
+	if err != nil {
+		return err
+	}
+
+	_, err = git.PlainCloneContext(ctx, destination, true, &git.CloneOptions{
+		Auth: auth,
+		URL:  cloneUrl,
+	})
+
+	if err == nil {
+		return scrubRemotes(destination)
+	}
+
+	err = redact(err, opts)
+
+	// there is no point in retrying a clone for a repo that does not exist or one that ran out of time
+	if errors.Is(err, transport.ErrRepositoryNotFound) || errors.Is(err, transport.ErrEmptyRemoteRepository) || ctx.Err() != nil {
+		return err
+	}
+
+	if cfg.GitBin != "" {
+		logger.Printf("Failed with error: %s - Falling back to shell clone\n", err)
+		os.RemoveAll(destination)
+		return cloneFallback(ctx, cfg, cloneUrl, destination, opts)
+	}
+
+	return err
+}
+
+// downloadLfsObjects will fetch the lfs objects into the bare clone for repos that make use of lfs
+//
+// lfs is always fetched over https as the ssh transfer needs git-lfs-authenticate on the server
+func downloadLfsObjects(ctx context.Context, cfg *config.Config, repo *source.Repository, opts Options, logger *log.Logger) error {
+	repository, err := git.PlainOpen(cfg.Path.RepoPath(repo))
+	if err != nil {
+		return err
+	}
+
+	usesLfs, err := lfs.UsesLfs(repository)
+	if err != nil || !usesLfs {
+		return err
+	}
+
+	logger.Printf("%s uses lfs\n", repo.Name)
+
+	return lfs.Fetch(logger, repository, cfg.Path.RepoPath(repo), lfs.Remote{
+		Endpoint: lfs.Endpoint(repo.CloneURL),
+		Username: opts.Username,
+		Password: opts.Password,
+		Context:  ctx,
+	})
+}
+
+// downloadWiki will clone the wiki repo that sits alongside the main repo
+//
+// providers report the wiki as enabled even if no page has ever been created, in which case the wiki
+// repo does not exist and we just move on
+func downloadWiki(ctx context.Context, cfg *config.Config, repo *source.Repository, opts Options, logger *log.Logger) error {
+	wikiName := repo.Name + ".wiki"
+	wikiUrl := strings.TrimSuffix(repoCloneUrl(repo, opts), ".git") + ".wiki.git"
+
+	err := Bare(ctx, cfg, wikiName, wikiUrl, cfg.Path.WikiPath(repo), opts, logger)
+	if errors.Is(err, transport.ErrRepositoryNotFound) || errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		logger.Printf("no wiki found for %s\n", repo.Name)
+		os.RemoveAll(cfg.Path.WikiPath(repo))
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,178 @@
+package clone
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// localRepo creates a repo on disk with a single commit and returns the hash of that commit
+func localRepo(t *testing.T, dir string) plumbing.Hash {
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(path.Join(dir, "README.md"), []byte("# test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = worktree.Add("README.md"); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := worktree.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+// assertBareClone checks the destination is a bare repo with the given commit at its head
+func assertBareClone(t *testing.T, destination string, expected plumbing.Hash) {
+	if _, err := os.Stat(path.Join(destination, "HEAD")); err != nil {
+		t.Fatalf("expected a bare repo at %s: %s", destination, err)
+	}
+
+	repo, err := git.PlainOpen(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head.Hash() != expected {
+		t.Errorf("expected head %s, got %s", expected, head.Hash())
+	}
+}
+
+func testConfig(t *testing.T) *config.Config {
+	cfg := &config.Config{}
+	cfg.Path.RootDir = t.TempDir()
+	cfg.Path.ForceDate = "2021-06-01"
+
+	return cfg
+}
+
+func testLogger() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+func TestBare(t *testing.T) {
+	remote := path.Join(t.TempDir(), "project.git")
+	hash := localRepo(t, remote)
+
+	cfg := testConfig(t)
+	destination := path.Join(cfg.Path.DownloadPath(), "project")
+
+	// anything left behind by an earlier attempt is replaced
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(destination, "leftover"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Bare(context.Background(), cfg, "project", remote, destination, Options{}, testLogger()); err != nil {
+		t.Fatalf("clone failed: %s", err)
+	}
+
+	assertBareClone(t, destination, hash)
+
+	if _, err := os.Stat(path.Join(destination, "leftover")); !os.IsNotExist(err) {
+		t.Error("expected the previous attempt to be removed")
+	}
+}
+
+func TestBareMissingRepo(t *testing.T) {
+	cfg := testConfig(t)
+	destination := path.Join(cfg.Path.DownloadPath(), "missing")
+
+	err := Bare(context.Background(), cfg, "missing", path.Join(t.TempDir(), "missing.git"), destination, Options{}, testLogger())
+	if err == nil {
+		t.Fatal("expected cloning a missing repo to fail")
+	}
+}
+
+func TestRepoWithWiki(t *testing.T) {
+	remoteDir := t.TempDir()
+	hash := localRepo(t, path.Join(remoteDir, "project.git"))
+	wikiHash := localRepo(t, path.Join(remoteDir, "project.wiki.git"))
+
+	cfg := testConfig(t)
+	repo := &source.Repository{
+		Name:     "git/project",
+		CloneURL: path.Join(remoteDir, "project.git"),
+		HasWiki:  true,
+	}
+
+	if err := Repo(context.Background(), cfg, repo, Options{Wikis: true}, testLogger()); err != nil {
+		t.Fatalf("clone failed: %s", err)
+	}
+
+	assertBareClone(t, cfg.Path.RepoPath(repo), hash)
+	assertBareClone(t, cfg.Path.WikiPath(repo), wikiHash)
+}
+
+func TestRepoWithoutWikiRepo(t *testing.T) {
+	remoteDir := t.TempDir()
+	hash := localRepo(t, path.Join(remoteDir, "project.git"))
+
+	cfg := testConfig(t)
+	repo := &source.Repository{
+		Name:     "git/project",
+		CloneURL: path.Join(remoteDir, "project.git"),
+		HasWiki:  true,
+	}
+
+	// a wiki that is enabled but has never been written to has no repo, that is not a failure
+	if err := Repo(context.Background(), cfg, repo, Options{Wikis: true}, testLogger()); err != nil {
+		t.Fatalf("clone failed: %s", err)
+	}
+
+	assertBareClone(t, cfg.Path.RepoPath(repo), hash)
+
+	if _, err := os.Stat(cfg.Path.WikiPath(repo)); !os.IsNotExist(err) {
+		t.Error("expected no wiki to be left behind")
+	}
+}
+
+func TestRepoEmpty(t *testing.T) {
+	cfg := testConfig(t)
+	repo := &source.Repository{
+		Name:     "git/empty",
+		CloneURL: path.Join(t.TempDir(), "empty.git"),
+		Empty:    true,
+	}
+
+	if err := Repo(context.Background(), cfg, repo, Options{}, testLogger()); err != nil {
+		t.Fatalf("expected an empty repo to be skipped: %s", err)
+	}
+
+	if _, err := os.Stat(cfg.Path.RepoPath(repo)); !os.IsNotExist(err) {
+		t.Error("expected nothing to be cloned for an empty repo")
+	}
+}
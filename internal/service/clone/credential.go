@@ -0,0 +1,184 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/go-git/go-git/v5"
+)
+
+// env vars the askpass script reads the credentials from, unlike command line args the environment of a
+// process is only readable by its own user
+const (
+	askPassUserEnv     = "GHB_GIT_USERNAME"
+	askPassPasswordEnv = "GHB_GIT_PASSWORD"
+)
+
+// askPassScript answers the username and password prompts of the git cli from the environment
+const askPassScript = `#!/bin/sh
+case "$1" in
+	Username*) printf '%s\n' "$` + askPassUserEnv + `" ;;
+	*) printf '%s\n' "$` + askPassPasswordEnv + `" ;;
+esac
+`
+
+// matches the userinfo of any url in a message so credentials we don't know about are also removed
+var urlUserinfoPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s]+@`)
+
+// redactedError hides any credentials in the message of the wrapped error while still allowing it to be
+// checked with errors.Is/As
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// cloneFallback will only be called if the standard clone/download fails and the conf.GitBin var is set
+//
+// It will attempt to use the git cli application to do the clone instead of the go lib, credentials are
+// handed over by an askpass script so they never appear in the process list or the cloned repos config
+func cloneFallback(ctx context.Context, cfg *config.Config, cloneUrl, destination string, opts Options) error {
+	// any configured credential helper could otherwise store the credentials on disk
+	cmd := exec.CommandContext(ctx, cfg.GitBin, "-c", "credential.helper=", "clone", "--bare", scrubUrl(cloneUrl), destination)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	// credentials embedded in the url are moved over to the askpass script along with the rest
+	username, password := opts.Username, opts.Password
+	if parsed, err := url.Parse(cloneUrl); err == nil && parsed.User != nil && password == "" {
+		username = parsed.User.Username()
+		password, _ = parsed.User.Password()
+	}
+
+	if isSshUrl(cloneUrl) {
+		cmd.Env = append(sshCommandEnv(opts.Ssh), "GIT_TERMINAL_PROMPT=0")
+	} else if password != "" {
+		askPass, err := writeAskPass()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(askPass)
+
+		cmd.Env = append(
+			cmd.Env,
+			"GIT_ASKPASS="+askPass,
+			askPassUserEnv+"="+username,
+			askPassPasswordEnv+"="+password,
+		)
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		// the kill signal tells us nothing, the deadline is what matters for deciding on a retry
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		return redact(fmt.Errorf("%w: %s", err, strings.TrimSpace(output.String())), opts)
+	}
+
+	return scrubRemotes(destination)
+}
+
+// writeAskPass writes the askpass script to a temp file only readable by us, the caller is responsible
+// for removing it
+func writeAskPass() (string, error) {
+	file, err := ioutil.TempFile("", "ghb-askpass-*")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err = file.WriteString(askPassScript); err == nil {
+		err = file.Chmod(0700)
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// scrubUrl removes any credentials embedded in an https url
+func scrubUrl(cloneUrl string) string {
+	if isSshUrl(cloneUrl) {
+		return cloneUrl
+	}
+
+	parsed, err := url.Parse(cloneUrl)
+	if err != nil || parsed.User == nil {
+		return cloneUrl
+	}
+
+	parsed.User = nil
+	return parsed.String()
+}
+
+// scrubRemotes removes credentials from the remote urls saved in the config of a cloned repo so they
+// don't end up in the archive
+func scrubRemotes(repoPath string) error {
+	repository, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return err
+	}
+
+	repoConfig, err := repository.Config()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, remote := range repoConfig.Remotes {
+		for i, remoteUrl := range remote.URLs {
+			if scrubbed := scrubUrl(remoteUrl); scrubbed != remoteUrl {
+				remote.URLs[i] = scrubbed
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return repository.Storer.SetConfig(repoConfig)
+}
+
+// redact will remove the configured password and any url credentials from the error message
+func redact(err error, opts Options) error {
+	if err == nil {
+		return nil
+	}
+
+	message := urlUserinfoPattern.ReplaceAllString(err.Error(), "$1***@")
+	for _, secret := range []string{opts.Password, opts.Ssh.Passphrase} {
+		if secret != "" {
+			message = strings.ReplaceAll(message, secret, "***")
+		}
+	}
+
+	if message == err.Error() {
+		return err
+	}
+
+	return &redactedError{message: message, err: err}
+}
@@ -0,0 +1,232 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/go-git/go-git/v5"
+	gitConfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// refs kept in sync with the remote, pull request refs are left out as they are read only on
+// github and can easily outnumber the branches
+var mirrorRefSpecs = []gitConfig.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// syncMirror will bring the persistent mirror at destination up to date with the remote
+//
+// refs are force updated so force pushes are picked up and refs removed from the remote are pruned,
+// a mirror that can not be opened or fails its integrity check is removed and cloned again
+func syncMirror(ctx context.Context, cfg *config.Config, name, cloneUrl, destination string, opts Options, logger *log.Logger) error {
+	if _, err := os.Stat(destination); err != nil {
+		logger.Printf("creating mirror for %s\n", name)
+		return cloneMirror(ctx, cfg, name, cloneUrl, destination, opts, logger)
+	}
+
+	// the fetch negotiates from the local ref tips so they have to be checked before fetching
+	err := verifyMirror(destination)
+	if err == nil {
+		err = fetchMirror(ctx, cloneUrl, destination, opts)
+		if err == nil || errors.Is(err, transport.ErrRepositoryNotFound) || errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			return err
+		}
+
+		// a network failure should not throw away the mirror, only re-clone it if it is actually broken
+		if verifyErr := verifyMirror(destination); verifyErr == nil {
+			return err
+		}
+	}
+
+	logger.Printf("mirror for %s is corrupt (%s), cloning again\n", name, redact(err, opts))
+	if err = os.RemoveAll(destination); err != nil {
+		return err
+	}
+
+	return cloneMirror(ctx, cfg, name, cloneUrl, destination, opts, logger)
+}
+
+// cloneMirror creates a new bare repo with the mirror refspecs and does the initial fetch
+func cloneMirror(ctx context.Context, cfg *config.Config, name, cloneUrl, destination string, opts Options, logger *log.Logger) error {
+	_, err := git.PlainInit(destination, true)
+	if err == nil {
+		err = fetchMirror(ctx, cloneUrl, destination, opts)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	os.RemoveAll(destination)
+	if errors.Is(err, transport.ErrRepositoryNotFound) || errors.Is(err, transport.ErrEmptyRemoteRepository) || ctx.Err() != nil {
+		return err
+	}
+
+	if cfg.GitBin != "" {
+		logger.Printf("Failed with error: %s - Falling back to shell clone\n", redact(err, opts))
+		return cloneFallback(ctx, cfg, cloneUrl, destination, opts)
+	}
+
+	return err
+}
+
+// fetchMirror will fetch every branch and tag into the mirror, prune the refs that no longer exist
+// on the remote and point HEAD at the remotes default branch
+func fetchMirror(ctx context.Context, cloneUrl, destination string, opts Options) error {
+	repository, err := git.PlainOpen(destination)
+	if err != nil {
+		return err
+	}
+
+	auth, err := cloneAuth(cloneUrl, opts)
+	if err != nil {
+		return err
+	}
+
+	remote := git.NewRemote(repository.Storer, &gitConfig.RemoteConfig{
+		Name:  git.DefaultRemoteName,
+		URLs:  []string{cloneUrl},
+		Fetch: mirrorRefSpecs,
+	})
+
+	remoteRefs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return err
+	}
+
+	// go-git has no equivalent of git fetch --prune so we list first and prune ourselves
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		Auth:     auth,
+		RefSpecs: mirrorRefSpecs,
+		Force:    true,
+		Tags:     git.NoTags,
+	})
+
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	if err = pruneMirror(repository, remoteRefs); err != nil {
+		return err
+	}
+
+	return updateMirrorHead(repository, remoteRefs)
+}
+
+// pruneMirror removes the local branches and tags that are not in the remote ref list
+func pruneMirror(repository *git.Repository, remoteRefs []*plumbing.Reference) error {
+	existing := make(map[plumbing.ReferenceName]bool)
+	for _, ref := range remoteRefs {
+		existing[ref.Name()] = true
+	}
+
+	refs, err := repository.References()
+	if err != nil {
+		return err
+	}
+
+	var stale []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if (ref.Name().IsBranch() || ref.Name().IsTag()) && !existing[ref.Name()] {
+			stale = append(stale, ref.Name())
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range stale {
+		if err = repository.Storer.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateMirrorHead points HEAD at the same branch as the remote HEAD
+//
+// servers that don't advertise the symref only give the hash so the branch is found by matching it
+func updateMirrorHead(repository *git.Repository, remoteRefs []*plumbing.Reference) error {
+	var head *plumbing.Reference
+	for _, ref := range remoteRefs {
+		if ref.Name() == plumbing.HEAD {
+			head = ref
+		}
+	}
+
+	if head == nil {
+		return nil
+	}
+
+	target := head.Target()
+	if head.Type() == plumbing.HashReference {
+		target = ""
+		for _, ref := range remoteRefs {
+			if ref.Name().IsBranch() && ref.Hash() == head.Hash() {
+				target = ref.Name()
+				break
+			}
+		}
+	}
+
+	if target == "" {
+		return nil
+	}
+
+	return repository.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, target))
+}
+
+// verifyMirror checks that HEAD can be read and every branch and tag resolves to a commit (or tag) that
+// can be read
+//
+// this is not a full connectivity check but catches mirrors that have lost objects or been truncated
+func verifyMirror(destination string) error {
+	repository, err := git.PlainOpen(destination)
+	if err != nil {
+		return err
+	}
+
+	// HEAD is rewritten on every fetch so it only has to be readable, not point at an existing branch
+	head, err := repository.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+
+	if head.Type() != plumbing.SymbolicReference && head.Hash().IsZero() {
+		return errors.New("HEAD is not a valid ref")
+	}
+
+	refs, err := repository.References()
+	if err != nil {
+		return err
+	}
+
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || !strings.HasPrefix(ref.Name().String(), "refs/") {
+			return nil
+		}
+
+		obj, err := repository.Object(plumbing.AnyObject, ref.Hash())
+		if err != nil {
+			return err
+		}
+
+		if commit, ok := obj.(*object.Commit); ok {
+			_, err = commit.Tree()
+		}
+
+		return err
+	})
+}
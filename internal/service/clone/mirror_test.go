@@ -0,0 +1,208 @@
+package clone
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitOnBranch adds a commit on top of parent to a new branch of the repo and returns its hash
+func commitOnBranch(t *testing.T, dir, branch string, parent plumbing.Hash) plumbing.Hash {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = worktree.Checkout(&git.CheckoutOptions{
+		Branch: plumbing.NewBranchReferenceName(branch),
+		Hash:   parent,
+		Create: true,
+		Force:  true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(path.Join(dir, branch+".txt"), []byte(branch+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = worktree.Add(branch + ".txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := worktree.Commit("commit on "+branch, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leave the default branch checked out so the remote HEAD does not move
+	if err = worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.Master, Force: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+// setBranch points the branch of the repo at the hash, a zero hash removes it
+func setBranch(t *testing.T, dir, branch string, hash plumbing.Hash) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := plumbing.NewBranchReferenceName(branch)
+	if hash.IsZero() {
+		err = repo.Storer.RemoveReference(name)
+	} else {
+		err = repo.Storer.SetReference(plumbing.NewHashReference(name, hash))
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mirrorBranch returns the hash the branch points to in the mirror, or a zero hash if it does not exist
+func mirrorBranch(t *testing.T, destination, branch string) plumbing.Hash {
+	repo, err := git.PlainOpen(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), false)
+	if err == plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ref.Hash()
+}
+
+func testMirror(t *testing.T) (string, string, plumbing.Hash) {
+	remote := path.Join(t.TempDir(), "project.git")
+	hash := localRepo(t, remote)
+
+	return remote, path.Join(t.TempDir(), "project.mirror"), hash
+}
+
+func runSync(t *testing.T, remote, destination string) {
+	err := syncMirror(context.Background(), testConfig(t), "project", remote, destination, Options{}, testLogger())
+	if err != nil {
+		t.Fatalf("sync failed: %s", err)
+	}
+}
+
+func TestSyncMirrorForcePushedBranch(t *testing.T) {
+	remote, destination, initial := testMirror(t)
+	feature := commitOnBranch(t, remote, "feature", initial)
+
+	runSync(t, remote, destination)
+	assertBareClone(t, destination, initial)
+
+	if actual := mirrorBranch(t, destination, "feature"); actual != feature {
+		t.Fatalf("expected feature at %s, got %s", feature, actual)
+	}
+
+	// rewrite the branch so the new tip does not descend from the mirrored one
+	rewritten := commitOnBranch(t, remote, "rewrite", initial)
+	setBranch(t, remote, "feature", rewritten)
+
+	runSync(t, remote, destination)
+
+	if actual := mirrorBranch(t, destination, "feature"); actual != rewritten {
+		t.Errorf("expected the force push to move feature to %s, got %s", rewritten, actual)
+	}
+}
+
+func TestSyncMirrorPrunesDeletedBranch(t *testing.T) {
+	remote, destination, initial := testMirror(t)
+	feature := commitOnBranch(t, remote, "feature", initial)
+
+	runSync(t, remote, destination)
+
+	if actual := mirrorBranch(t, destination, "feature"); actual != feature {
+		t.Fatalf("expected feature at %s, got %s", feature, actual)
+	}
+
+	// a file that only survives if the mirror is synced in place
+	marker := path.Join(destination, "marker")
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	setBranch(t, remote, "feature", plumbing.ZeroHash)
+	runSync(t, remote, destination)
+
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("expected the healthy mirror to be synced in place: %s", err)
+	}
+
+	if actual := mirrorBranch(t, destination, "feature"); !actual.IsZero() {
+		t.Errorf("expected the deleted branch to be pruned, still at %s", actual)
+	}
+
+	assertBareClone(t, destination, initial)
+}
+
+func TestSyncMirrorReclonesCorruptMirror(t *testing.T) {
+	tests := map[string]func(t *testing.T, destination string){
+		"missing head": func(t *testing.T, destination string) {
+			if err := os.Remove(path.Join(destination, "HEAD")); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"garbage head": func(t *testing.T, destination string) {
+			if err := ioutil.WriteFile(path.Join(destination, "HEAD"), []byte("garbage\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"objects": func(t *testing.T, destination string) {
+			if err := os.RemoveAll(path.Join(destination, "objects")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.MkdirAll(path.Join(destination, "objects"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+
+	for name, corrupt := range tests {
+		remote, destination, initial := testMirror(t)
+		runSync(t, remote, destination)
+
+		marker := path.Join(destination, "marker")
+		if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		corrupt(t, destination)
+		runSync(t, remote, destination)
+
+		assertBareClone(t, destination, initial)
+
+		if _, err := os.Stat(marker); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the corrupt mirror to be cloned again", name)
+		}
+	}
+}
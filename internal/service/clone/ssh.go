@@ -0,0 +1,103 @@
+package clone
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// repoCloneUrl picks the clone url for the repo based on the configured protocol
+func repoCloneUrl(repo *source.Repository, opts Options) string {
+	if opts.Protocol == config.ProtocolSsh && repo.SSHURL != "" {
+		return repo.SSHURL
+	}
+
+	return repo.CloneURL
+}
+
+// isSshUrl checks for both the scp style (git@github.com:org/repo.git) and ssh:// urls
+func isSshUrl(cloneUrl string) bool {
+	if strings.HasPrefix(cloneUrl, "ssh://") {
+		return true
+	}
+
+	return !strings.Contains(cloneUrl, "://") && strings.Contains(cloneUrl, "@")
+}
+
+// cloneAuth builds the auth method to go with the clone url
+func cloneAuth(cloneUrl string, opts Options) (transport.AuthMethod, error) {
+	if !isSshUrl(cloneUrl) {
+		return &http.BasicAuth{
+			Username: opts.Username,
+			Password: opts.Password,
+		}, nil
+	}
+
+	return sshAuth(opts.Ssh)
+}
+
+// sshAuth will load the configured key or fall back to the ssh-agent
+//
+// host keys are always verified against known_hosts, there is deliberately no way to turn this off
+func sshAuth(sshConfig config.SshConfig) (transport.AuthMethod, error) {
+	hostKeyCallback, err := ssh.NewKnownHostsCallback(knownHostsFiles(sshConfig)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+	}
+
+	if sshConfig.KeyPath == "" {
+		auth, err := ssh.NewSSHAgentAuth(sshConfig.User)
+		if err != nil {
+			return nil, fmt.Errorf("no ssh key_path set and ssh-agent is unavailable: %w", err)
+		}
+
+		auth.HostKeyCallback = hostKeyCallback
+		return auth, nil
+	}
+
+	auth, err := ssh.NewPublicKeysFromFile(sshConfig.User, sshConfig.KeyPath, sshConfig.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.HostKeyCallback = hostKeyCallback
+	return auth, nil
+}
+
+// knownHostsFiles will return the configured known_hosts file, when empty go-git falls back to
+// $SSH_KNOWN_HOSTS or the users ~/.ssh/known_hosts
+func knownHostsFiles(sshConfig config.SshConfig) []string {
+	if sshConfig.KnownHosts == "" {
+		return nil
+	}
+
+	return []string{sshConfig.KnownHosts}
+}
+
+// sshCommandEnv builds the GIT_SSH_COMMAND for the git cli fallback to match the go-git settings
+//
+// batch mode stops ssh from prompting so passphrase protected keys need to be loaded into the agent
+func sshCommandEnv(sshConfig config.SshConfig) []string {
+	command := []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes"}
+
+	if sshConfig.KnownHosts != "" {
+		command = append(command, "-o", "UserKnownHostsFile="+shellQuote(sshConfig.KnownHosts))
+	}
+
+	if sshConfig.KeyPath != "" {
+		command = append(command, "-o", "IdentitiesOnly=yes", "-i", shellQuote(sshConfig.KeyPath))
+	}
+
+	return append(os.Environ(), "GIT_SSH_COMMAND="+strings.Join(command, " "))
+}
+
+// shellQuote wraps a path in single quotes as GIT_SSH_COMMAND is run through the shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,243 @@
+package gitea
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/service/clone"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/source/filter"
+	"github.com/aceviralltd/github-backup/internal/util"
+)
+
+const (
+	// repos are kept in their own namespace so they can't collide with the github org repos
+	Namespace = "gitea"
+
+	RepoMetaFile = "repo.json"
+
+	// the default max page size of an instance, larger limits are silently capped
+	pageLimit = 50
+)
+
+// repository covers the parts of the api response needed by the pipeline
+type repository struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Owner struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	Description   string    `json:"description"`
+	CloneURL      string    `json:"clone_url"`
+	SSHURL        string    `json:"ssh_url"`
+	DefaultBranch string    `json:"default_branch"`
+	Private       bool      `json:"private"`
+	Internal      bool      `json:"internal"`
+	Language      string    `json:"language"`
+	Topics        []string  `json:"topics"`
+	Fork          bool      `json:"fork"`
+	Archived      bool      `json:"archived"`
+	HasWiki       bool      `json:"has_wiki"`
+	Empty         bool      `json:"empty"`
+	Size          int       `json:"size"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Source lists and backs up the repos of the configured gitea (or forgejo) orgs and users
+type Source struct {
+	cfg    *config.Config
+	filter *filter.Filter
+	client *http.Client
+}
+
+// NewSource will create the gitea source, validating the repo filters on the way
+//
+// the token owner has to be given along with the token as https clones need a username and the
+// owners private repos can only be listed through their own endpoint
+func NewSource(cfg *config.Config) (*Source, error) {
+	if cfg.Gitea.Token != "" && cfg.Gitea.Username == "" {
+		return nil, errors.New("gitea username is required along with the token")
+	}
+
+	repoFilter, err := filter.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{cfg: cfg, filter: repoFilter, client: &http.Client{}}, nil
+}
+
+// Name identifies the source in logs
+func (s *Source) Name() string {
+	return Namespace
+}
+
+// ListRepos will return the repos of the configured orgs and users that pass the filters
+//
+// a repo that is listed more than once is only returned the first time
+func (s *Source) ListRepos() ([]*source.Repository, error) {
+	var repoList []*source.Repository
+	seen := make(map[int64]bool)
+
+	add := func(owner string) func([]json.RawMessage) error {
+		return func(page []json.RawMessage) error {
+			for _, raw := range page {
+				repo, id, err := sourceRepository(raw)
+				if err != nil {
+					return err
+				}
+
+				// the token owners listing includes the repos of every org they are a member of
+				if seen[id] || !strings.EqualFold(repo.Owner, owner) {
+					continue
+				}
+				seen[id] = true
+
+				if s.filter.Match(repo) {
+					repoList = append(repoList, repo)
+				}
+			}
+
+			return nil
+		}
+	}
+
+	for _, org := range s.cfg.Gitea.Orgs {
+		if err := s.paginate(fmt.Sprintf("orgs/%s/repos", url.PathEscape(org)), add(org)); err != nil {
+			return nil, fmt.Errorf("failed to list org %s: %w", org, err)
+		}
+	}
+
+	for _, user := range s.cfg.Gitea.Users {
+		// the user endpoint only lists public repos, the token owner can list their own private ones
+		endpoint := fmt.Sprintf("users/%s/repos", url.PathEscape(user))
+		if strings.EqualFold(user, s.cfg.Gitea.Username) {
+			endpoint = "user/repos"
+		}
+
+		if err := s.paginate(endpoint, add(user)); err != nil {
+			return nil, fmt.Errorf("failed to list user %s: %w", user, err)
+		}
+	}
+
+	return repoList, nil
+}
+
+// Download will clone the repo along with its wiki (if it has one)
+func (s *Source) Download(ctx context.Context, repo *source.Repository, logger *log.Logger) error {
+	return clone.Repo(ctx, s.cfg, repo, clone.Options{
+		Protocol: s.cfg.Gitea.Protocol,
+		Username: s.cfg.Gitea.Username,
+		Password: s.cfg.Gitea.Token,
+		Ssh:      s.cfg.Gitea.Ssh,
+		Wikis:    s.cfg.Gitea.Wikis,
+		Lfs:      s.cfg.Gitea.Lfs,
+	}, logger)
+}
+
+// Export will write the full repo response to the repos meta dir when settings are exported
+func (s *Source) Export(repo *source.Repository, logger *log.Logger) error {
+	if !s.cfg.Export.Settings {
+		return nil
+	}
+
+	logger.Println("exporting repo")
+	return util.WriteJson(path.Join(s.cfg.Path.MetaPath(repo), RepoMetaFile), repo.Native)
+}
+
+// paginate will call handle with each page of results until the Link header has no next page
+func (s *Source) paginate(endpoint string, handle func([]json.RawMessage) error) error {
+	for page := 1; ; page++ {
+		var results []json.RawMessage
+
+		headers, err := s.get(fmt.Sprintf("%s?limit=%d&page=%d", endpoint, pageLimit, page), &results)
+		if err != nil {
+			return err
+		}
+
+		if err = handle(results); err != nil {
+			return err
+		}
+
+		if len(results) == 0 || !strings.Contains(headers.Get("Link"), `rel="next"`) {
+			return nil
+		}
+	}
+}
+
+// get will make an authenticated request to the v1 api and decode the response into target
+func (s *Source) get(endpoint string, target interface{}) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, s.cfg.Gitea.BaseUrl+"/api/v1/"+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cfg.Gitea.Token != "" {
+		req.Header.Set("Authorization", "token "+s.cfg.Gitea.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gitea responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp.Header, json.Unmarshal(body, target)
+}
+
+// sourceRepository converts the api response into the details needed by the pipeline
+//
+// the raw response is kept as the native repo so nothing is lost from the repo export
+func sourceRepository(raw json.RawMessage) (*source.Repository, int64, error) {
+	var repo repository
+	if err := json.Unmarshal(raw, &repo); err != nil {
+		return nil, 0, err
+	}
+
+	visibility := "public"
+	if repo.Private {
+		visibility = "private"
+	} else if repo.Internal {
+		visibility = "internal"
+	}
+
+	// gitea has no pushed_at, updated_at is bumped by every push
+	return &source.Repository{
+		Name:          path.Join(Namespace, repo.Owner.Login, repo.Name),
+		Owner:         repo.Owner.Login,
+		Description:   repo.Description,
+		CloneURL:      repo.CloneURL,
+		SSHURL:        repo.SSHURL,
+		DefaultBranch: repo.DefaultBranch,
+		Visibility:    visibility,
+		Language:      repo.Language,
+		Topics:        repo.Topics,
+		Fork:          repo.Fork,
+		Archived:      repo.Archived,
+		HasWiki:       repo.HasWiki,
+		Empty:         repo.Empty,
+		Size:          repo.Size,
+		PushedAt:      repo.UpdatedAt,
+		UpdatedAt:     repo.UpdatedAt,
+		Native:        raw,
+	}, repo.ID, nil
+}
@@ -0,0 +1,263 @@
+package gitea
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+)
+
+const (
+	testToken    = "gitea-test"
+	testUsername = "backup"
+)
+
+// fakeGitea serves the repo listing endpoints of the v1 api from a fixed set of repos
+type fakeGitea struct {
+	*httptest.Server
+
+	// repos by the listing path they are served from (orgs/<org>, users/<user> or user)
+	listings map[string][]map[string]interface{}
+	// the instance caps the page size below the limit the client asks for
+	pageSize int
+	// every request path that reached the api, with the page
+	requests []string
+}
+
+func newFakeGitea(t *testing.T) *fakeGitea {
+	fake := &fakeGitea{
+		listings: make(map[string][]map[string]interface{}),
+		pageSize: 2,
+	}
+
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.Close)
+
+	return fake
+}
+
+func (f *fakeGitea) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "token "+testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"message":"token is required"}`)
+		return
+	}
+
+	f.requests = append(f.requests, r.URL.Path+"?page="+r.URL.Query().Get("page"))
+
+	listing := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/repos")
+	repos, ok := f.listings[listing]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"not found"}`)
+		return
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	start := (page - 1) * f.pageSize
+	end := start + f.pageSize
+	if end >= len(repos) {
+		end = len(repos)
+	} else {
+		next := *r.URL
+		query := next.Query()
+		query.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = query.Encode()
+
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s>; rel="next"`, f.URL, next.String()))
+	}
+
+	if start > end {
+		start = end
+	}
+
+	json.NewEncoder(w).Encode(repos[start:end])
+}
+
+func testRepo(id int, owner, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             id,
+		"name":           name,
+		"owner":          map[string]interface{}{"login": owner},
+		"clone_url":      "https://gitea.example.com/" + owner + "/" + name + ".git",
+		"ssh_url":        "git@gitea.example.com:" + owner + "/" + name + ".git",
+		"default_branch": "main",
+		"private":        true,
+		"size":           1024,
+		"updated_at":     "2021-06-02T10:00:00Z",
+	}
+}
+
+func testSource(t *testing.T, baseUrl string) *Source {
+	cfg := &config.Config{}
+	cfg.Gitea.BaseUrl = baseUrl
+	cfg.Gitea.Username = testUsername
+	cfg.Gitea.Token = testToken
+
+	src, err := NewSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return src
+}
+
+func repoNames(t *testing.T, src *Source) []string {
+	repos, err := src.ListRepos()
+	if err != nil {
+		t.Fatalf("failed to list repos: %s", err)
+	}
+
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func TestNewSourceRequiresUsername(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Gitea.BaseUrl = "https://gitea.example.com"
+	cfg.Gitea.Token = testToken
+
+	if _, err := NewSource(cfg); err == nil {
+		t.Error("expected a token without a username to be rejected")
+	}
+
+	// public repos can still be backed up without any credentials
+	cfg.Gitea.Token = ""
+	if _, err := NewSource(cfg); err != nil {
+		t.Errorf("expected no credentials to be accepted, got %s", err)
+	}
+}
+
+func TestListReposPaginatesWithLinkHeader(t *testing.T) {
+	fake := newFakeGitea(t)
+	fake.listings["orgs/acme"] = []map[string]interface{}{
+		testRepo(1, "acme", "api"),
+		testRepo(2, "acme", "web"),
+		testRepo(3, "acme", "deploy"),
+		testRepo(4, "acme", "infra"),
+		testRepo(5, "acme", "tools"),
+	}
+
+	src := testSource(t, fake.URL)
+	src.cfg.Gitea.Orgs = []string{"acme"}
+
+	names := repoNames(t, src)
+	expected := []string{"gitea/acme/api", "gitea/acme/deploy", "gitea/acme/infra", "gitea/acme/tools", "gitea/acme/web"}
+
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	// the page size is capped below the requested limit so the Link header has to be followed
+	if len(fake.requests) != 3 {
+		t.Errorf("expected the org to be fetched over 3 pages, got %v", fake.requests)
+	}
+}
+
+func TestListReposOrgsAndUsers(t *testing.T) {
+	fake := newFakeGitea(t)
+	fake.listings["orgs/acme"] = []map[string]interface{}{
+		testRepo(1, "acme", "api"),
+	}
+	fake.listings["users/alice"] = []map[string]interface{}{
+		testRepo(10, "alice", "dotfiles"),
+		testRepo(11, "alice", "notes"),
+	}
+	// the token owners listing includes the repos of the orgs they are a member of
+	fake.listings["user"] = []map[string]interface{}{
+		testRepo(1, "acme", "api"),
+		testRepo(20, testUsername, "private-tools"),
+		testRepo(21, "other-org", "secret"),
+	}
+
+	src := testSource(t, fake.URL)
+	src.cfg.Gitea.Orgs = []string{"acme"}
+	src.cfg.Gitea.Users = []string{"alice", "Backup"}
+
+	names := repoNames(t, src)
+	expected := []string{
+		"gitea/acme/api",
+		"gitea/alice/dotfiles",
+		"gitea/alice/notes",
+		"gitea/backup/private-tools",
+	}
+
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	for _, request := range fake.requests {
+		if strings.HasPrefix(request, "/api/v1/users/Backup/") {
+			t.Errorf("expected the token owner to be listed through /user/repos, got %s", request)
+		}
+	}
+}
+
+func TestListReposConvertsRepos(t *testing.T) {
+	fake := newFakeGitea(t)
+	fake.listings["orgs/acme"] = []map[string]interface{}{testRepo(1, "acme", "api")}
+
+	src := testSource(t, fake.URL)
+	src.cfg.Gitea.Orgs = []string{"acme"}
+
+	repos, err := src.ListRepos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(repos) != 1 {
+		t.Fatalf("expected a single repo, got %d", len(repos))
+	}
+
+	repo := repos[0]
+	if repo.Owner != "acme" || repo.Visibility != "private" || repo.DefaultBranch != "main" {
+		t.Errorf("unexpected repo details: %+v", repo)
+	}
+
+	if repo.CloneURL != "https://gitea.example.com/acme/api.git" || repo.SSHURL != "git@gitea.example.com:acme/api.git" {
+		t.Errorf("unexpected clone urls: %s %s", repo.CloneURL, repo.SSHURL)
+	}
+
+	if repo.PushedAt.Format("2006-01-02") != "2021-06-02" {
+		t.Errorf("expected the pushed time to come from updated_at, got %s", repo.PushedAt)
+	}
+}
+
+func TestListReposRequiresToken(t *testing.T) {
+	fake := newFakeGitea(t)
+	fake.listings["orgs/acme"] = []map[string]interface{}{testRepo(1, "acme", "api")}
+
+	src := testSource(t, fake.URL)
+	src.cfg.Gitea.Token = "wrong"
+	src.cfg.Gitea.Orgs = []string{"acme"}
+
+	if _, err := src.ListRepos(); err == nil {
+		t.Fatal("expected listing to fail with an invalid token")
+	}
+}
+
+func TestListReposMissingOrg(t *testing.T) {
+	fake := newFakeGitea(t)
+
+	src := testSource(t, fake.URL)
+	src.cfg.Gitea.Orgs = []string{"missing"}
+
+	if _, err := src.ListRepos(); err == nil {
+		t.Fatal("expected listing a missing org to fail")
+	}
+}
@@ -0,0 +1,177 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/util"
+	"github.com/google/go-github/v34/github"
+)
+
+// ExportActions will download the workflow definitions, the most recent runs along with their logs and
+// every artifact that has not yet expired into the repos actions dir
+func ExportActions(cfg *config.Config, repo *source.Repository, logger *log.Logger) error {
+	ctx := context.Background()
+	client := githubClient(cfg)
+	owner := repo.Owner
+	name := repo.Name
+	actionsPath := cfg.Path.ActionsPath(repo)
+
+	var workflows []*github.Workflow
+	opt := &github.ListOptions{PerPage: 100}
+	err := paginate(opt, func() (*github.Response, error) {
+		page, resp, err := client.Actions.ListWorkflows(ctx, owner, name, opt)
+		if page != nil {
+			workflows = append(workflows, page.Workflows...)
+		}
+
+		return resp, err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// repos that have never used actions have nothing else worth exporting
+	if len(workflows) == 0 {
+		return nil
+	}
+
+	if err = util.WriteJson(path.Join(actionsPath, "workflows.json"), workflows); err != nil {
+		return err
+	}
+
+	runs, err := listRecentRuns(ctx, client, owner, name, cfg.Export.ActionsRuns)
+	if err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		logUrl, _, err := client.Actions.GetWorkflowRunLogs(ctx, owner, name, run.GetID(), true)
+		if err != nil {
+			// logs are removed with the retention period of the repo so older runs may not have any
+			if hasStatus(err, http.StatusNotFound, http.StatusGone) {
+				continue
+			}
+
+			return err
+		}
+
+		logPath := path.Join(actionsPath, "logs", fmt.Sprintf("%d.zip", run.GetID()))
+		if err = downloadFile(logUrl.String(), logPath); err != nil {
+			return err
+		}
+	}
+
+	if err = util.WriteJson(path.Join(actionsPath, "runs.json"), runs); err != nil {
+		return err
+	}
+
+	var artifacts []*github.Artifact
+	opt = &github.ListOptions{PerPage: 100}
+	err = paginate(opt, func() (*github.Response, error) {
+		page, resp, err := client.Actions.ListArtifacts(ctx, owner, name, opt)
+		if page != nil {
+			artifacts = append(artifacts, page.Artifacts...)
+		}
+
+		return resp, err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, artifact := range artifacts {
+		if artifact.GetExpired() {
+			continue
+		}
+
+		size += artifact.GetSizeInBytes()
+
+		logger.Printf("downloading artifact %s\n", artifact.GetName())
+
+		artifactUrl, _, err := client.Actions.DownloadArtifact(ctx, owner, name, artifact.GetID(), true)
+		if err != nil {
+			if hasStatus(err, http.StatusNotFound, http.StatusGone) {
+				continue
+			}
+
+			return err
+		}
+
+		artifactPath := path.Join(actionsPath, "artifacts", fmt.Sprintf("%d-%s.zip", artifact.GetID(), path.Base(artifact.GetName())))
+		if err = downloadFile(artifactUrl.String(), artifactPath); err != nil {
+			return err
+		}
+	}
+
+	sizes := config.LastExportSizes(cfg, repo)
+	sizes.Actions = size
+	config.RecordExportSizes(cfg, repo, sizes)
+
+	return util.WriteJson(path.Join(actionsPath, "artifacts.json"), artifacts)
+}
+
+// listRecentRuns will page through the workflow runs (newest first) until the limit is reached
+func listRecentRuns(ctx context.Context, client *github.Client, owner, name string, limit int) ([]*github.WorkflowRun, error) {
+	var runs []*github.WorkflowRun
+
+	opt := &github.ListWorkflowRunsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for len(runs) < limit {
+		page, resp, err := client.Actions.ListRepositoryWorkflowRuns(ctx, owner, name, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		runs = append(runs, page.WorkflowRuns...)
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	return runs, nil
+}
+
+// downloadFile will stream the content of a (pre-signed) url to disk
+func downloadFile(url, filePath string) error {
+	response, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed with status %s", response.Status)
+	}
+
+	if err = os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, response.Body)
+	return err
+}
@@ -0,0 +1,152 @@
+package github
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aceviralltd/github-backup/internal/util"
+)
+
+// headers that describe the current request rather than the cached resource, these are always
+// taken from the live response
+var liveHeaders = []string{
+	"Date",
+	"X-Ratelimit-Limit",
+	"X-Ratelimit-Remaining",
+	"X-Ratelimit-Reset",
+	"X-Ratelimit-Used",
+	"X-Ratelimit-Resource",
+}
+
+// query params that change on every run, these are left out of the cache key so each run replaces the
+// entry of the last one rather than adding another, the ETag still tells if the response changed
+var volatileParams = []string{"since"}
+
+// etagCacheTransport stores api responses on disk along with their ETag so that following runs can
+// make conditional requests, github does not count 304 responses against the rate limit
+type etagCacheTransport struct {
+	base     http.RoundTripper
+	cacheDir string
+}
+
+// cachedResponse is the on disk format of a cached api response
+type cachedResponse struct {
+	URL    string
+	ETag   string
+	Header http.Header
+	Body   []byte
+}
+
+// newEtagCacheTransport wraps the given transport storing cached responses in the cache dir
+func newEtagCacheTransport(base http.RoundTripper, cacheDir string) *etagCacheTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &etagCacheTransport{
+		base:     base,
+		cacheDir: cacheDir,
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *etagCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	key := cacheKey(req)
+	cachePath := t.cachePath(key)
+	cached := &cachedResponse{}
+	if err := util.ReadJson(cachePath, cached); err != nil || cached.URL != key {
+		cached = nil
+	}
+
+	if cached != nil {
+		// the request is shared with the caller so it must not be modified
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return cached.response(req, resp), nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return resp, nil
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	// failing to cache is not a reason to fail the request
+	_ = util.WriteJson(cachePath, &cachedResponse{
+		URL:    key,
+		ETag:   etag,
+		Header: resp.Header,
+		Body:   data,
+	})
+
+	return resp, nil
+}
+
+// cachePath builds the location of the cache file for the cache key
+func (t *etagCacheTransport) cachePath(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(hash[:])
+
+	return path.Join(t.cacheDir, name[0:2], name+".json")
+}
+
+// cacheKey is the request url without the volatile params, the accept header is included in the key as
+// it changes the shape of the response
+func cacheKey(req *http.Request) string {
+	keyUrl := *req.URL
+	query := keyUrl.Query()
+	for _, param := range volatileParams {
+		query.Del(param)
+	}
+
+	keyUrl.RawQuery = query.Encode()
+
+	return keyUrl.String() + "\n" + req.Header.Get("Accept")
+}
+
+// response rebuilds the cached response using the rate limit headers from the live 304 response
+func (c *cachedResponse) response(req *http.Request, live *http.Response) *http.Response {
+	header := c.Header.Clone()
+	for _, name := range liveHeaders {
+		if value := live.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         live.Proto,
+		ProtoMajor:    live.ProtoMajor,
+		ProtoMinor:    live.ProtoMinor,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+	}
+}
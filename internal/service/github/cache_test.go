@@ -0,0 +1,173 @@
+package github
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeEtagApi serves a fixed body with an ETag and answers matching conditional requests with a 304
+type fakeEtagApi struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	etag        string
+	body        string
+	contentType string
+	// the If-None-Match header of every request that reached the server
+	conditions []string
+}
+
+func newFakeEtagApi(t *testing.T) *fakeEtagApi {
+	fake := &fakeEtagApi{etag: `"v1"`, body: `[{"id":1}]`, contentType: "application/json; charset=utf-8"}
+
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.Close)
+
+	return fake
+}
+
+func (f *fakeEtagApi) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.conditions = append(f.conditions, r.Header.Get("If-None-Match"))
+	w.Header().Set("X-RateLimit-Remaining", "4999")
+
+	if f.etag != "" && r.Header.Get("If-None-Match") == f.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if f.etag != "" {
+		w.Header().Set("ETag", f.etag)
+	}
+
+	w.Header().Set("Content-Type", f.contentType)
+	w.Write([]byte(f.body))
+}
+
+func cacheEntries(t *testing.T, cacheDir string) int {
+	files, err := filepath.Glob(filepath.Join(cacheDir, "*", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(files)
+}
+
+func fetch(t *testing.T, client *http.Client, method, url string) (int, string) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func TestEtagCacheReplaysNotModified(t *testing.T) {
+	fake := newFakeEtagApi(t)
+	cacheDir := t.TempDir()
+	client := &http.Client{Transport: newEtagCacheTransport(nil, cacheDir)}
+
+	if status, body := fetch(t, client, http.MethodGet, fake.URL+"/repos/org/repo/issues"); status != http.StatusOK || body != fake.body {
+		t.Fatalf("unexpected first response %d %q", status, body)
+	}
+
+	status, body := fetch(t, client, http.MethodGet, fake.URL+"/repos/org/repo/issues")
+	if status != http.StatusOK || body != fake.body {
+		t.Errorf("expected the cached body to be replayed as a 200, got %d %q", status, body)
+	}
+
+	if len(fake.conditions) != 2 || fake.conditions[0] != "" || fake.conditions[1] != `"v1"` {
+		t.Errorf("expected the second request to be conditional, got %q", fake.conditions)
+	}
+
+	// a changed resource replaces the cached entry
+	fake.etag = `"v2"`
+	fake.body = `[{"id":2}]`
+
+	if status, body = fetch(t, client, http.MethodGet, fake.URL+"/repos/org/repo/issues"); body != fake.body {
+		t.Errorf("expected the changed body, got %d %q", status, body)
+	}
+
+	if count := cacheEntries(t, cacheDir); count != 1 {
+		t.Errorf("expected a single cache entry, got %d", count)
+	}
+}
+
+func TestEtagCacheIgnoresSince(t *testing.T) {
+	fake := newFakeEtagApi(t)
+	cacheDir := t.TempDir()
+	client := &http.Client{Transport: newEtagCacheTransport(nil, cacheDir)}
+
+	fetch(t, client, http.MethodGet, fake.URL+"/repos/org/repo/issues?state=all&since=2021-06-01T00:00:00Z")
+	fetch(t, client, http.MethodGet, fake.URL+"/repos/org/repo/issues?state=all&since=2021-06-02T00:00:00Z")
+
+	if count := cacheEntries(t, cacheDir); count != 1 {
+		t.Errorf("expected runs with a different since to share a cache entry, got %d", count)
+	}
+
+	if fake.conditions[1] != `"v1"` {
+		t.Errorf("expected the request with a new since to be conditional, got %q", fake.conditions)
+	}
+
+	// other params still make a different request
+	fetch(t, client, http.MethodGet, fake.URL+"/repos/org/repo/issues?state=open")
+	if count := cacheEntries(t, cacheDir); count != 2 {
+		t.Errorf("expected a separate entry for a different query, got %d", count)
+	}
+}
+
+func TestEtagCacheSkipsUncacheable(t *testing.T) {
+	tests := map[string]struct {
+		method      string
+		etag        string
+		contentType string
+	}{
+		"post":        {http.MethodPost, `"v1"`, "application/json"},
+		"put":         {http.MethodPut, `"v1"`, "application/json"},
+		"no etag":     {http.MethodGet, "", "application/json"},
+		"not json":    {http.MethodGet, `"v1"`, "application/octet-stream"},
+		"html errors": {http.MethodGet, `"v1"`, "text/html"},
+	}
+
+	for name, test := range tests {
+		fake := newFakeEtagApi(t)
+		fake.etag = test.etag
+		fake.contentType = test.contentType
+
+		cacheDir := t.TempDir()
+		client := &http.Client{Transport: newEtagCacheTransport(nil, cacheDir)}
+
+		fetch(t, client, test.method, fake.URL+"/repos/org/repo")
+		status, body := fetch(t, client, test.method, fake.URL+"/repos/org/repo")
+
+		if status != http.StatusOK || body != fake.body {
+			t.Errorf("%s: expected the live response, got %d %q", name, status, body)
+		}
+
+		if fake.conditions[1] != "" {
+			t.Errorf("%s: expected no conditional request, got %q", name, fake.conditions[1])
+		}
+
+		if cacheEntries(t, cacheDir) != 0 {
+			t.Errorf("%s: expected nothing to be cached", name)
+		}
+	}
+}
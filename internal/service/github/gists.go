@@ -0,0 +1,169 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/service/clone"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/util"
+	"github.com/google/go-github/v34/github"
+)
+
+const (
+	GistNamespace = "gists"
+	GistMetaFile  = "gist.json"
+)
+
+// ListGists will return the gists for the configured users and optionally all org members
+//
+// gists are returned as repos named gists/<owner>/<id> so they can be passed through the same
+// pipeline as the org repos and end up in their own namespace
+func ListGists(cfg *config.Config) ([]*source.Repository, error) {
+	var repoList []*source.Repository
+
+	users := cfg.Github.GistUsers
+	if cfg.Github.OrgMemberGists {
+		members, err := listOrgMembers(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, members...)
+	}
+
+	seen := make(map[string]bool)
+	for _, user := range users {
+		if seen[strings.ToLower(user)] {
+			continue
+		}
+		seen[strings.ToLower(user)] = true
+
+		gists, err := listUserGists(cfg, user)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, gist := range gists {
+			repoList = append(repoList, gistRepository(gist))
+		}
+	}
+
+	return repoList, nil
+}
+
+// IsGist checks if the repo was created from a gist by ListGists
+func IsGist(repo *source.Repository) bool {
+	return strings.HasPrefix(repo.Name, GistNamespace+"/")
+}
+
+// downloadGist will clone the gist and write its description and file metadata alongside it
+func downloadGist(ctx context.Context, cfg *config.Config, repo *source.Repository, logger *log.Logger) error {
+	if err := clone.Bare(ctx, cfg, repo.Name, repo.CloneURL, cfg.Path.RepoPath(repo), cloneOptions(cfg), logger); err != nil {
+		return err
+	}
+
+	if gist, ok := repo.Native.(*github.Gist); ok {
+		return util.WriteJson(path.Join(cfg.Path.MetaPath(repo), GistMetaFile), gist)
+	}
+
+	return nil
+}
+
+// listUserGists pages through the gists for a single user
+//
+// the authenticated user is listed without a name so that their secret gists are included
+func listUserGists(cfg *config.Config, user string) ([]*github.Gist, error) {
+	var gistList []*github.Gist
+
+	client := githubClient(cfg)
+	ctx := context.Background()
+
+	if strings.EqualFold(user, cfg.Github.Username) {
+		user = ""
+	}
+
+	opt := &github.GistListOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for {
+		gists, resp, err := client.Gists.List(ctx, user, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		gistList = append(gistList, gists...)
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	return gistList, nil
+}
+
+// listOrgMembers will return the logins of the org members
+//
+// not every account is permitted to list members, in which case there are just no members to add
+func listOrgMembers(cfg *config.Config) ([]string, error) {
+	var members []string
+
+	client := githubClient(cfg)
+	ctx := context.Background()
+
+	opt := &github.ListMembersOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for {
+		users, resp, err := client.Organizations.ListMembers(ctx, cfg.Github.OrgName, opt)
+		if err != nil {
+			if hasStatus(err, http.StatusForbidden) {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		for _, user := range users {
+			members = append(members, user.GetLogin())
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	return members, nil
+}
+
+// gistRepository builds up the repo details needed by the pipeline from a gist
+//
+// the gist itself is kept as the native repo so its description and file metadata can be written out
+// with the clone
+func gistRepository(gist *github.Gist) *source.Repository {
+	visibility := "public"
+	if !gist.GetPublic() {
+		visibility = "private"
+	}
+
+	return &source.Repository{
+		Name:        fmt.Sprintf("%s/%s/%s", GistNamespace, gist.GetOwner().GetLogin(), gist.GetID()),
+		Owner:       gist.GetOwner().GetLogin(),
+		Description: gist.GetDescription(),
+		CloneURL:    gist.GetGitPullURL(),
+		Visibility:  visibility,
+		UpdatedAt:   gist.GetUpdatedAt(),
+		PushedAt:    gist.GetUpdatedAt(),
+		Native:      gist,
+	}
+}
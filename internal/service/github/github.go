@@ -2,21 +2,111 @@ package github
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os/exec"
 
 	"github.com/aceviralltd/github-backup/internal/config"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/aceviralltd/github-backup/internal/service/clone"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/source/filter"
 	"github.com/google/go-github/v34/github"
 )
 
 var githubApiClient *github.Client
+var githubRateLimiter *rateLimitTransport
 
-// ListRepos will return a full list of the repos in the organisation
-func ListRepos(cfg *config.Config) ([]*github.Repository, error) {
-	var repoList []*github.Repository
+// Source lists and backs up the repos of the configured github org along with the gists of its users
+type Source struct {
+	cfg    *config.Config
+	filter *filter.Filter
+}
+
+// NewSource will create the github source, validating the repo filters on the way
+func NewSource(cfg *config.Config) (*Source, error) {
+	repoFilter, err := filter.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{cfg: cfg, filter: repoFilter}, nil
+}
+
+// Name identifies the source in logs
+func (s *Source) Name() string {
+	return "github"
+}
+
+// ListRepos will return the org repos that pass the configured filters followed by the gists
+func (s *Source) ListRepos() ([]*source.Repository, error) {
+	var repoList []*source.Repository
+
+	if s.cfg.Github.OrgName != "" {
+		repos, err := listOrgRepos(s.cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repo := range repos {
+			if s.filter.Match(repo) {
+				repoList = append(repoList, repo)
+			}
+		}
+	}
+
+	gists, err := ListGists(s.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(repoList, gists...), nil
+}
+
+// Download will attempt to clone a repo along with its wiki (if it has one)
+func (s *Source) Download(ctx context.Context, repo *source.Repository, logger *log.Logger) error {
+	if IsGist(repo) {
+		return downloadGist(ctx, s.cfg, repo, logger)
+	}
+
+	return clone.Repo(ctx, s.cfg, repo, cloneOptions(s.cfg), logger)
+}
+
+// Export will run each of the enabled github data exports for the repo
+//
+// gists have none of the extra data that can be exported
+func (s *Source) Export(repo *source.Repository, logger *log.Logger) error {
+	if IsGist(repo) {
+		return nil
+	}
+
+	exports := []struct {
+		name    string
+		enabled bool
+		export  func(*config.Config, *source.Repository, *log.Logger) error
+	}{
+		{"issues", s.cfg.Export.Issues, ExportIssues},
+		{"releases", s.cfg.Export.Releases, ExportReleases},
+		{"actions", s.cfg.Export.Actions, ExportActions},
+		{"settings", s.cfg.Export.Settings, ExportSettings},
+	}
+
+	for _, export := range exports {
+		if !export.enabled {
+			continue
+		}
+
+		logger.Printf("exporting %s\n", export.name)
+		if err := export.export(s.cfg, repo, logger); err != nil {
+			return fmt.Errorf("failed to export %s: %w", export.name, err)
+		}
+	}
+
+	return nil
+}
+
+// listOrgRepos will return every repo in the organisation
+func listOrgRepos(cfg *config.Config) ([]*source.Repository, error) {
+	var repoList []*source.Repository
 
 	client := githubClient(cfg)
 	ctx := context.Background()
@@ -31,7 +121,10 @@ func ListRepos(cfg *config.Config) ([]*github.Repository, error) {
 			return nil, err
 		}
 
-		repoList = append(repoList, repos...)
+		for _, repo := range repos {
+			repoList = append(repoList, repository(repo))
+		}
+
 		if resp.NextPage == 0 {
 			break
 		}
@@ -42,65 +135,70 @@ func ListRepos(cfg *config.Config) ([]*github.Repository, error) {
 	return repoList, nil
 }
 
-// DownloadRepo will attempt to clone a repo
-func DownloadRepo(cfg *config.Config, repo *github.Repository, logger *log.Logger) (string, error) {
-	// if there is no download url it means that the repo is empty so we can just skip it
-	if repo.GetArchiveURL() == "" {
-		return "", nil
+// repository converts the api response into the details needed by the pipeline
+func repository(repo *github.Repository) *source.Repository {
+	return &source.Repository{
+		Name:          repo.GetName(),
+		Owner:         repo.GetOwner().GetLogin(),
+		Description:   repo.GetDescription(),
+		CloneURL:      repo.GetCloneURL(),
+		SSHURL:        repo.GetSSHURL(),
+		DefaultBranch: repo.GetDefaultBranch(),
+		Visibility:    repoVisibility(repo),
+		Language:      repo.GetLanguage(),
+		Topics:        repo.Topics,
+		Fork:          repo.GetFork(),
+		Archived:      repo.GetArchived(),
+		HasWiki:       repo.GetHasWiki(),
+		// if there is no download url it means that the repo is empty
+		Empty:     repo.GetArchiveURL() == "",
+		Size:      repo.GetSize(),
+		PushedAt:  repo.GetPushedAt().Time,
+		UpdatedAt: repo.GetUpdatedAt().Time,
+		Native:    repo,
 	}
+}
 
-	_, err := git.PlainClone(cfg.Path.RepoPath(repo), true, &git.CloneOptions{
-		Auth: &http.BasicAuth{
-			Username: cfg.Github.Username,
-			Password: cfg.Github.Password,
-		},
-		URL: repo.GetCloneURL(),
-	})
-
-	if err != nil {
-		if cfg.GitBin != "" {
-			logger.Printf("Failed with error: %s - Falling back to shell clone\n", err)
-			return downloadRepoFallback(cfg, repo)
-		}
+// repoVisibility will resolve the visibility of the repo
+//
+// older github responses don't include the visibility field so we fall back to the private flag
+func repoVisibility(repo *github.Repository) string {
+	if repo.GetVisibility() != "" {
+		return repo.GetVisibility()
+	}
 
-		return "", err
+	if repo.GetPrivate() {
+		return "private"
 	}
 
-	return cfg.Path.RepoPath(repo), nil
+	return "public"
 }
 
-// downloadRepoFallback will only be called if the standard clone/download fails and the conf.GitBin var is set
-//
-// It will attempt to use the git cli application to do the clone instead of the go lib
-func downloadRepoFallback(cfg *config.Config, repo *github.Repository) (string, error) {
-	cloneUrl := fmt.Sprintf(
-		"https://%s:%s@github.com/%s/%s",
-		cfg.Github.Username,
-		cfg.Github.Password,
-		cfg.Github.OrgName,
-		repo.GetName(),
-	)
-
-	cmd := exec.Command(
-		cfg.GitBin,
-		"clone",
-		cloneUrl,
-		cfg.Path.RepoPath(repo),
-		"--bare",
-	)
-
-	if err := cmd.Run(); err != nil {
-		return "", err
-	}
-
-	return cfg.Path.RepoPath(repo), nil
+// cloneOptions for the github repos and gists
+func cloneOptions(cfg *config.Config) clone.Options {
+	return clone.Options{
+		Protocol: cfg.Github.Protocol,
+		Username: cfg.Github.Username,
+		Password: cfg.Github.Password,
+		Ssh:      cfg.Github.Ssh,
+		Wikis:    cfg.Github.Wikis,
+		Lfs:      cfg.Github.Lfs,
+	}
 }
 
 func githubClient(cfg *config.Config) *github.Client {
 	if githubApiClient == nil {
+		githubRateLimiter = newRateLimitTransport(nil)
+
 		auth := github.BasicAuthTransport{
-			Username: cfg.Github.Username,
-			Password: cfg.Github.Password,
+			Username:  cfg.Github.Username,
+			Password:  cfg.Github.Password,
+			Transport: githubRateLimiter,
+		}
+
+		// the cache sits above the rate limiter so 304 responses still update the known quota
+		if cfg.Github.EtagCache {
+			auth.Transport = newEtagCacheTransport(githubRateLimiter, cfg.Path.HttpCachePath())
 		}
 
 		githubApiClient = github.NewClient(auth.Client())
@@ -108,3 +206,28 @@ func githubClient(cfg *config.Config) *github.Client {
 
 	return githubApiClient
 }
+
+// RateLimitSummary describes the api quota remaining after the run
+func RateLimitSummary() string {
+	if githubRateLimiter == nil {
+		return "github api: no requests made"
+	}
+
+	return githubRateLimiter.Summary()
+}
+
+// hasStatus checks if the error is an api error response with one of the given status codes
+func hasStatus(err error, statusCodes ...int) bool {
+	var errResponse *github.ErrorResponse
+	if !errors.As(err, &errResponse) || errResponse.Response == nil {
+		return false
+	}
+
+	for _, statusCode := range statusCodes {
+		if errResponse.Response.StatusCode == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
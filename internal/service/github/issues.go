@@ -0,0 +1,347 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/util"
+	"github.com/google/go-github/v34/github"
+)
+
+const (
+	IssueStateFile = "issues.json"
+)
+
+// issueExport holds everything exported from the issue tracker of a repo
+//
+// It is kept in the state dir between runs so that each run only has to fetch the items that have
+// been updated since the last one, the full set is still written to every archive
+type issueExport struct {
+	UpdatedAt      time.Time
+	Issues         map[int]*github.Issue
+	PullRequests   map[int]*github.PullRequest
+	IssueComments  map[int64]*github.IssueComment
+	ReviewComments map[int64]*github.PullRequestComment
+	Labels         []*github.Label
+	Milestones     []*github.Milestone
+	Reactions      map[string][]*github.Reaction
+}
+
+// ExportIssues will fetch the issues, pull requests and their comments for the repo and write them
+// as json files to the repos meta dir
+func ExportIssues(cfg *config.Config, repo *source.Repository, logger *log.Logger) error {
+	ctx := context.Background()
+	client := githubClient(cfg)
+	statePath := cfg.Path.RepoStatePath(repo, IssueStateFile)
+	started := time.Now()
+
+	export := loadIssueExport(statePath)
+	if !export.UpdatedAt.IsZero() {
+		logger.Printf("fetching issues updated since %s\n", export.UpdatedAt.Format(time.RFC3339))
+	}
+
+	steps := []func(context.Context, *github.Client, *source.Repository, *issueExport) error{
+		fetchIssues,
+		fetchPullRequests,
+		fetchIssueComments,
+		fetchReviewComments,
+		fetchLabels,
+		fetchMilestones,
+	}
+
+	for _, step := range steps {
+		// github responds with a 410 for features (issues) that have been disabled on the repo
+		if err := step(ctx, client, repo, export); err != nil && !hasStatus(err, http.StatusGone) {
+			return err
+		}
+	}
+
+	metaPath := cfg.Path.MetaPath(repo)
+	files := map[string]interface{}{
+		"issues.json":          export.Issues,
+		"pull_requests.json":   export.PullRequests,
+		"issue_comments.json":  export.IssueComments,
+		"review_comments.json": export.ReviewComments,
+		"labels.json":          export.Labels,
+		"milestones.json":      export.Milestones,
+		"reactions.json":       export.Reactions,
+	}
+
+	for name, data := range files {
+		if err := util.WriteJson(path.Join(metaPath, name), data); err != nil {
+			return err
+		}
+	}
+
+	export.UpdatedAt = started
+	return util.WriteJson(statePath, export)
+}
+
+// loadIssueExport from the state dir, if there is no usable state a fresh export is returned
+func loadIssueExport(statePath string) *issueExport {
+	export := &issueExport{}
+
+	if _, err := os.Stat(statePath); err == nil {
+		if err = util.ReadJson(statePath, export); err != nil {
+			export = &issueExport{}
+		}
+	}
+
+	if export.Issues == nil {
+		export.Issues = make(map[int]*github.Issue)
+	}
+
+	if export.PullRequests == nil {
+		export.PullRequests = make(map[int]*github.PullRequest)
+	}
+
+	if export.IssueComments == nil {
+		export.IssueComments = make(map[int64]*github.IssueComment)
+	}
+
+	if export.ReviewComments == nil {
+		export.ReviewComments = make(map[int64]*github.PullRequestComment)
+	}
+
+	if export.Reactions == nil {
+		export.Reactions = make(map[string][]*github.Reaction)
+	}
+
+	return export
+}
+
+// fetchIssues updated since the last export, github includes pull requests in this list too
+func fetchIssues(ctx context.Context, client *github.Client, repo *source.Repository, export *issueExport) error {
+	opt := &github.IssueListByRepoOptions{
+		State:       "all",
+		Sort:        "updated",
+		Direction:   "asc",
+		Since:       export.UpdatedAt,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for {
+		issues, resp, err := client.Issues.ListByRepo(ctx, repo.Owner, repo.Name, opt)
+		if err != nil {
+			return err
+		}
+
+		for _, issue := range issues {
+			export.Issues[issue.GetNumber()] = issue
+
+			if issue.GetReactions().GetTotalCount() == 0 {
+				continue
+			}
+
+			key := fmt.Sprintf("issue/%d", issue.GetNumber())
+			if export.Reactions[key], err = fetchReactions(func(opt *github.ListOptions) ([]*github.Reaction, *github.Response, error) {
+				return client.Reactions.ListIssueReactions(ctx, repo.Owner, repo.Name, issue.GetNumber(), opt)
+			}); err != nil {
+				return err
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	return nil
+}
+
+// fetchPullRequests updated since the last export
+//
+// the pull request endpoint has no since filter so we sort by last updated and stop paging once we
+// reach a pull request that was already exported
+func fetchPullRequests(ctx context.Context, client *github.Client, repo *source.Repository, export *issueExport) error {
+	opt := &github.PullRequestListOptions{
+		State:       "all",
+		Sort:        "updated",
+		Direction:   "desc",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for {
+		pulls, resp, err := client.PullRequests.List(ctx, repo.Owner, repo.Name, opt)
+		if err != nil {
+			return err
+		}
+
+		for _, pull := range pulls {
+			if pull.GetUpdatedAt().Before(export.UpdatedAt) {
+				return nil
+			}
+
+			export.PullRequests[pull.GetNumber()] = pull
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	return nil
+}
+
+// fetchIssueComments for all issues and pull requests in the repo updated since the last export
+func fetchIssueComments(ctx context.Context, client *github.Client, repo *source.Repository, export *issueExport) error {
+	opt := &github.IssueListCommentsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	if !export.UpdatedAt.IsZero() {
+		opt.Since = &export.UpdatedAt
+	}
+
+	for {
+		comments, resp, err := client.Issues.ListComments(ctx, repo.Owner, repo.Name, 0, opt)
+		if err != nil {
+			return err
+		}
+
+		for _, comment := range comments {
+			export.IssueComments[comment.GetID()] = comment
+
+			if comment.GetReactions().GetTotalCount() == 0 {
+				continue
+			}
+
+			key := fmt.Sprintf("issue_comment/%d", comment.GetID())
+			if export.Reactions[key], err = fetchReactions(func(opt *github.ListOptions) ([]*github.Reaction, *github.Response, error) {
+				return client.Reactions.ListIssueCommentReactions(ctx, repo.Owner, repo.Name, comment.GetID(), opt)
+			}); err != nil {
+				return err
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	return nil
+}
+
+// fetchReviewComments for all pull requests in the repo updated since the last export
+func fetchReviewComments(ctx context.Context, client *github.Client, repo *source.Repository, export *issueExport) error {
+	opt := &github.PullRequestListCommentsOptions{
+		Sort:        "updated",
+		Direction:   "asc",
+		Since:       export.UpdatedAt,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for {
+		comments, resp, err := client.PullRequests.ListComments(ctx, repo.Owner, repo.Name, 0, opt)
+		if err != nil {
+			return err
+		}
+
+		for _, comment := range comments {
+			export.ReviewComments[comment.GetID()] = comment
+
+			if comment.GetReactions().GetTotalCount() == 0 {
+				continue
+			}
+
+			key := fmt.Sprintf("review_comment/%d", comment.GetID())
+			if export.Reactions[key], err = fetchReactions(func(opt *github.ListOptions) ([]*github.Reaction, *github.Response, error) {
+				return client.Reactions.ListPullRequestCommentReactions(ctx, repo.Owner, repo.Name, comment.GetID(), opt)
+			}); err != nil {
+				return err
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	return nil
+}
+
+// fetchLabels for the repo, there are never many so we always fetch the full list
+func fetchLabels(ctx context.Context, client *github.Client, repo *source.Repository, export *issueExport) error {
+	var labels []*github.Label
+	opt := &github.ListOptions{PerPage: 100}
+
+	for {
+		page, resp, err := client.Issues.ListLabels(ctx, repo.Owner, repo.Name, opt)
+		if err != nil {
+			return err
+		}
+
+		labels = append(labels, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	export.Labels = labels
+	return nil
+}
+
+// fetchMilestones for the repo, open and closed
+func fetchMilestones(ctx context.Context, client *github.Client, repo *source.Repository, export *issueExport) error {
+	var milestones []*github.Milestone
+	opt := &github.MilestoneListOptions{
+		State:       "all",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for {
+		page, resp, err := client.Issues.ListMilestones(ctx, repo.Owner, repo.Name, opt)
+		if err != nil {
+			return err
+		}
+
+		milestones = append(milestones, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	export.Milestones = milestones
+	return nil
+}
+
+// fetchReactions will page through one of the many reaction list endpoints
+func fetchReactions(list func(*github.ListOptions) ([]*github.Reaction, *github.Response, error)) ([]*github.Reaction, error) {
+	var reactions []*github.Reaction
+	opt := &github.ListOptions{PerPage: 100}
+
+	for {
+		page, resp, err := list(opt)
+		if err != nil {
+			return nil, err
+		}
+
+		reactions = append(reactions, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	return reactions, nil
+}
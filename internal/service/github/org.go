@@ -0,0 +1,281 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/util"
+	"github.com/google/go-github/v34/github"
+)
+
+const (
+	// OrgSnapshotVersion should be bumped whenever the structure of orgSnapshot changes
+	OrgSnapshotVersion = 1
+
+	RedactedValue = "REDACTED"
+)
+
+// orgSnapshot holds everything needed to rebuild the organisation around its repos
+type orgSnapshot struct {
+	Version               int
+	CreatedAt             time.Time
+	Organization          *github.Organization
+	Members               map[string]string
+	OutsideCollaborators  []*github.User
+	Teams                 []*orgTeam
+	Hooks                 []*github.Hook
+	CustomRepositoryRoles json.RawMessage
+	Repositories          map[string]*repoAccess
+}
+
+// orgTeam is a team along with its members, the parent team is included on the team itself
+type orgTeam struct {
+	Team        *github.Team
+	Maintainers []string
+	Members     []string
+}
+
+// repoAccess covers who and what has access to a single repo
+type repoAccess struct {
+	Teams         []*github.Team
+	Collaborators []*github.User
+	Hooks         []*github.Hook
+	DeployKeys    []*github.Key
+}
+
+// ExportOrgSnapshot will write a snapshot of the org configuration to the given path
+//
+// some sections require org admin access, these are left empty rather than failing the export
+func ExportOrgSnapshot(cfg *config.Config, repos []*source.Repository, snapshotPath string, logger *log.Logger) error {
+	var err error
+
+	ctx := context.Background()
+	client := githubClient(cfg)
+	org := cfg.Github.OrgName
+
+	snapshot := &orgSnapshot{
+		Version:      OrgSnapshotVersion,
+		CreatedAt:    time.Now(),
+		Members:      make(map[string]string),
+		Repositories: make(map[string]*repoAccess),
+	}
+
+	if snapshot.Organization, _, err = client.Organizations.Get(ctx, org); err != nil {
+		return err
+	}
+
+	logger.Println("exporting org members")
+	for _, role := range []string{"admin", "member"} {
+		opt := &github.ListMembersOptions{Role: role, ListOptions: github.ListOptions{PerPage: 100}}
+		err = paginate(&opt.ListOptions, func() (*github.Response, error) {
+			users, resp, err := client.Organizations.ListMembers(ctx, org, opt)
+			for _, user := range users {
+				snapshot.Members[user.GetLogin()] = role
+			}
+
+			return resp, err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	opt := &github.ListOutsideCollaboratorsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	err = paginate(&opt.ListOptions, func() (*github.Response, error) {
+		users, resp, err := client.Organizations.ListOutsideCollaborators(ctx, org, opt)
+		snapshot.OutsideCollaborators = append(snapshot.OutsideCollaborators, users...)
+
+		return resp, err
+	})
+
+	if err != nil && !hasStatus(err, http.StatusForbidden) {
+		return err
+	}
+
+	logger.Println("exporting org teams")
+	if snapshot.Teams, err = exportTeams(ctx, client, org); err != nil {
+		return err
+	}
+
+	listOpt := &github.ListOptions{PerPage: 100}
+	err = paginate(listOpt, func() (*github.Response, error) {
+		hooks, resp, err := client.Organizations.ListHooks(ctx, org, listOpt)
+		snapshot.Hooks = append(snapshot.Hooks, hooks...)
+
+		return resp, err
+	})
+
+	if err != nil && !hasStatus(err, http.StatusForbidden, http.StatusNotFound) {
+		return err
+	}
+
+	redactHooks(snapshot.Hooks)
+
+	if snapshot.CustomRepositoryRoles, err = exportCustomRepositoryRoles(ctx, client, org); err != nil {
+		return err
+	}
+
+	logger.Println("exporting repo access")
+	for _, repo := range repos {
+		if IsGist(repo) {
+			continue
+		}
+
+		if snapshot.Repositories[repo.Name], err = exportRepoAccess(ctx, client, repo); err != nil {
+			return err
+		}
+	}
+
+	return util.WriteJson(snapshotPath, snapshot)
+}
+
+// exportTeams will list every team in the org along with its members split by role
+func exportTeams(ctx context.Context, client *github.Client, org string) ([]*orgTeam, error) {
+	var teams []*orgTeam
+
+	opt := &github.ListOptions{PerPage: 100}
+	err := paginate(opt, func() (*github.Response, error) {
+		page, resp, err := client.Teams.ListTeams(ctx, org, opt)
+		for _, team := range page {
+			teams = append(teams, &orgTeam{Team: team})
+		}
+
+		return resp, err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, team := range teams {
+		for _, role := range []string{"maintainer", "member"} {
+			memberOpt := &github.TeamListTeamMembersOptions{Role: role, ListOptions: github.ListOptions{PerPage: 100}}
+			err = paginate(&memberOpt.ListOptions, func() (*github.Response, error) {
+				users, resp, err := client.Teams.ListTeamMembersBySlug(ctx, org, team.Team.GetSlug(), memberOpt)
+				for _, user := range users {
+					if role == "maintainer" {
+						team.Maintainers = append(team.Maintainers, user.GetLogin())
+					} else {
+						team.Members = append(team.Members, user.GetLogin())
+					}
+				}
+
+				return resp, err
+			})
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return teams, nil
+}
+
+// exportRepoAccess collects the team and user permissions, webhooks and deploy keys for a repo
+//
+// hooks and keys need admin access to the repo so they are skipped if we don't have it
+func exportRepoAccess(ctx context.Context, client *github.Client, repo *source.Repository) (*repoAccess, error) {
+	access := &repoAccess{}
+	owner := repo.Owner
+	name := repo.Name
+
+	opt := &github.ListOptions{PerPage: 100}
+	err := paginate(opt, func() (*github.Response, error) {
+		teams, resp, err := client.Repositories.ListTeams(ctx, owner, name, opt)
+		access.Teams = append(access.Teams, teams...)
+
+		return resp, err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	collaboratorOpt := &github.ListCollaboratorsOptions{Affiliation: "direct", ListOptions: github.ListOptions{PerPage: 100}}
+	err = paginate(&collaboratorOpt.ListOptions, func() (*github.Response, error) {
+		users, resp, err := client.Repositories.ListCollaborators(ctx, owner, name, collaboratorOpt)
+		access.Collaborators = append(access.Collaborators, users...)
+
+		return resp, err
+	})
+
+	if err != nil && !hasStatus(err, http.StatusForbidden) {
+		return nil, err
+	}
+
+	opt = &github.ListOptions{PerPage: 100}
+	err = paginate(opt, func() (*github.Response, error) {
+		hooks, resp, err := client.Repositories.ListHooks(ctx, owner, name, opt)
+		access.Hooks = append(access.Hooks, hooks...)
+
+		return resp, err
+	})
+
+	if err != nil && !hasStatus(err, http.StatusForbidden, http.StatusNotFound) {
+		return nil, err
+	}
+
+	redactHooks(access.Hooks)
+
+	opt = &github.ListOptions{PerPage: 100}
+	err = paginate(opt, func() (*github.Response, error) {
+		keys, resp, err := client.Repositories.ListKeys(ctx, owner, name, opt)
+		access.DeployKeys = append(access.DeployKeys, keys...)
+
+		return resp, err
+	})
+
+	if err != nil && !hasStatus(err, http.StatusForbidden, http.StatusNotFound) {
+		return nil, err
+	}
+
+	return access, nil
+}
+
+// exportCustomRepositoryRoles fetches the custom roles for the org
+//
+// the go-github client has no support for this endpoint so the raw response is kept as is, it is
+// only available on enterprise plans so a missing endpoint is not treated as an error
+func exportCustomRepositoryRoles(ctx context.Context, client *github.Client, org string) (json.RawMessage, error) {
+	var roles json.RawMessage
+	_, err := getRaw(ctx, client, fmt.Sprintf("orgs/%s/custom-repository-roles", org), &roles)
+
+	return roles, err
+}
+
+// redactHooks removes the secrets from the hook config
+//
+// github already masks them in the response but we don't want to rely on that
+func redactHooks(hooks []*github.Hook) {
+	for _, hook := range hooks {
+		if _, ok := hook.Config["secret"]; ok {
+			hook.Config["secret"] = RedactedValue
+		}
+	}
+}
+
+// paginate will keep calling the list function until there are no pages left
+//
+// the list function is expected to append its results as the page number is updated in opt
+func paginate(opt *github.ListOptions, list func() (*github.Response, error)) error {
+	for {
+		resp, err := list()
+		if err != nil {
+			return err
+		}
+
+		if resp.NextPage == 0 {
+			return nil
+		}
+
+		opt.Page = resp.NextPage
+	}
+}
@@ -0,0 +1,229 @@
+package github
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitTransport keeps the api client within the github rate limits
+//
+// it tracks the X-RateLimit-* headers of every response to slow down before the primary limit is
+// exhausted and retries requests that hit a secondary (abuse detection) limit
+type rateLimitTransport struct {
+	base   http.RoundTripper
+	logger *log.Logger
+
+	// fraction of the rate limit left at which requests start being spaced out until the reset
+	slowdown float64
+	// number of times a request will be retried after hitting a rate limit
+	maxRetries int
+	// wait used for secondary rate limits when github does not give a Retry-After
+	secondaryWait time.Duration
+	// upper bound of the randomness added to each retry wait
+	maxJitter time.Duration
+
+	mux       sync.Mutex
+	limit     int
+	remaining int
+	reset     time.Time
+	requests  int
+	retries   int
+	waited    time.Duration
+}
+
+// newRateLimitTransport wraps the given transport (or the default one if nil)
+func newRateLimitTransport(base http.RoundTripper) *rateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &rateLimitTransport{
+		base:          base,
+		logger:        log.New(os.Stdout, "rate: ", log.LstdFlags),
+		slowdown:      0.1,
+		maxRetries:    5,
+		secondaryWait: time.Minute,
+		maxJitter:     5 * time.Second,
+		remaining:     -1,
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.sleep(req, t.throttle()); err != nil {
+			return nil, err
+		}
+
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			req.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		t.update(resp)
+
+		wait, limited := t.limitedFor(resp, attempt)
+		if !limited || attempt >= t.maxRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+		t.logger.Printf("rate limited on %s, retrying in %s\n", req.URL.Path, wait.Round(time.Second))
+
+		t.mux.Lock()
+		t.retries++
+		t.mux.Unlock()
+
+		if err = t.sleep(req, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Summary describes the remaining quota and how much the transport has had to hold back
+func (t *rateLimitTransport) Summary() string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.remaining < 0 {
+		return fmt.Sprintf("github api: %d requests made", t.requests)
+	}
+
+	return fmt.Sprintf(
+		"github api: %d requests made, %d of %d remaining (resets %s), %d retries, %s spent waiting",
+		t.requests,
+		t.remaining,
+		t.limit,
+		t.reset.Format(time.RFC3339),
+		t.retries,
+		t.waited.Round(time.Second),
+	)
+}
+
+// throttle works out how long to wait before sending the next request
+//
+// once the remaining quota drops below the slowdown threshold the remaining requests are spread out
+// evenly until the reset, with no quota left we wait for the reset itself
+func (t *rateLimitTransport) throttle() time.Duration {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	untilReset := time.Until(t.reset)
+	if t.remaining < 0 || untilReset <= 0 {
+		return 0
+	}
+
+	if t.remaining == 0 {
+		return untilReset + time.Second
+	}
+
+	if float64(t.remaining) < float64(t.limit)*t.slowdown {
+		return untilReset / time.Duration(t.remaining)
+	}
+
+	return 0
+}
+
+// update the known quota from the response headers
+func (t *rateLimitTransport) update(resp *http.Response) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.requests++
+
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	// the search api has its own much smaller limit, it should not slow down everything else
+	if resp.Header.Get("X-RateLimit-Resource") == "search" {
+		return
+	}
+
+	t.remaining = remaining
+	t.limit, _ = strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		t.reset = time.Unix(reset, 0)
+	}
+}
+
+// limitedFor checks if the response was rejected by a rate limit and how long to wait before retrying
+func (t *rateLimitTransport) limitedFor(resp *http.Response, attempt int) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds)*time.Second + t.jitter(), true
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		t.mux.Lock()
+		defer t.mux.Unlock()
+
+		return time.Until(t.reset) + time.Second + t.jitter(), true
+	}
+
+	// secondary limits without a Retry-After can only be told apart from permission errors by the
+	// message so the body has to be read and then put back for the client to decode
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	message := strings.ToLower(string(data))
+	if err != nil || (!strings.Contains(message, "secondary rate limit") && !strings.Contains(message, "abuse")) {
+		return 0, false
+	}
+
+	return t.secondaryWait*time.Duration(1<<attempt) + t.jitter(), true
+}
+
+// sleep for the given duration unless the request is cancelled first
+func (t *rateLimitTransport) sleep(req *http.Request, wait time.Duration) error {
+	if wait <= 0 {
+		return nil
+	}
+
+	t.mux.Lock()
+	t.waited += wait
+	t.mux.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// jitter adds some randomness to a wait so retries don't all land at the same time
+func (t *rateLimitTransport) jitter() time.Duration {
+	if t.maxJitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(t.maxJitter)))
+}
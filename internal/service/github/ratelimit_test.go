@@ -0,0 +1,235 @@
+package github
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeApi answers each request with the next of its responses, the last one is repeated once they run out
+type fakeApi struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses []fakeResponse
+	// the body of every request that reached the server
+	bodies []string
+}
+
+type fakeResponse struct {
+	status  int
+	headers map[string]string
+	body    string
+}
+
+func newFakeApi(t *testing.T, responses ...fakeResponse) *fakeApi {
+	fake := &fakeApi{responses: responses}
+
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.Close)
+
+	return fake
+}
+
+func (f *fakeApi) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.bodies = append(f.bodies, string(body))
+
+	response := f.responses[len(f.responses)-1]
+	if len(f.bodies) <= len(f.responses) {
+		response = f.responses[len(f.bodies)-1]
+	}
+
+	for key, value := range response.headers {
+		w.Header().Set(key, value)
+	}
+
+	w.WriteHeader(response.status)
+	fmt.Fprint(w, response.body)
+}
+
+func (f *fakeApi) requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.bodies)
+}
+
+// testTransport has short waits so the retries can be run for real
+func testTransport() *rateLimitTransport {
+	transport := newRateLimitTransport(nil)
+	transport.logger = log.New(ioutil.Discard, "", 0)
+	transport.secondaryWait = 10 * time.Millisecond
+	transport.maxJitter = 0
+
+	return transport
+}
+
+func quotaHeaders(remaining, limit int, reset time.Time) map[string]string {
+	return map[string]string{
+		"X-RateLimit-Remaining": strconv.Itoa(remaining),
+		"X-RateLimit-Limit":     strconv.Itoa(limit),
+		"X-RateLimit-Reset":     strconv.FormatInt(reset.Unix(), 10),
+	}
+}
+
+func TestRateLimitSlowsDownNearTheLimit(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+
+	// the search api has its own limit that should not slow down everything else
+	search := quotaHeaders(1, 30, reset)
+	search["X-RateLimit-Resource"] = "search"
+
+	fake := newFakeApi(t, fakeResponse{status: http.StatusOK, headers: search})
+	transport := testTransport()
+	client := &http.Client{Transport: transport}
+
+	if _, err := client.Get(fake.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if wait := transport.throttle(); wait != 0 {
+		t.Errorf("expected the search quota to be ignored, got a wait of %s", wait)
+	}
+
+	fake.responses = []fakeResponse{{status: http.StatusOK, headers: quotaHeaders(4000, 5000, reset)}}
+	if _, err := client.Get(fake.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if wait := transport.throttle(); wait != 0 {
+		t.Errorf("expected no wait with plenty of quota left, got %s", wait)
+	}
+
+	// below the slowdown threshold the remaining requests are spread out until the reset
+	fake.responses = []fakeResponse{{status: http.StatusOK, headers: quotaHeaders(10, 5000, reset)}}
+	if _, err := client.Get(fake.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if wait := transport.throttle(); wait < 5*time.Minute || wait > 6*time.Minute {
+		t.Errorf("expected the requests to be spaced about 6 minutes apart, got %s", wait)
+	}
+}
+
+func TestRateLimitRetriesAfterRetryAfter(t *testing.T) {
+	fake := newFakeApi(t,
+		fakeResponse{status: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "0"}},
+		fakeResponse{status: http.StatusOK, body: "ok"},
+	)
+
+	transport := testTransport()
+	resp, err := (&http.Client{Transport: transport}).Get(fake.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || fake.requests() != 2 || transport.retries != 1 {
+		t.Errorf("expected a single retry to succeed, got %d after %d requests", resp.StatusCode, fake.requests())
+	}
+}
+
+func TestRateLimitWaitsOnSecondaryLimit(t *testing.T) {
+	fake := newFakeApi(t,
+		fakeResponse{status: http.StatusForbidden, body: `{"message":"You have exceeded a secondary rate limit"}`},
+		fakeResponse{status: http.StatusOK, body: "ok"},
+	)
+
+	transport := testTransport()
+	resp, err := (&http.Client{Transport: transport}).Get(fake.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || fake.requests() != 2 {
+		t.Errorf("expected the secondary limit to be retried, got %d after %d requests", resp.StatusCode, fake.requests())
+	}
+
+	if transport.waited < transport.secondaryWait {
+		t.Errorf("expected to wait at least %s, waited %s", transport.secondaryWait, transport.waited)
+	}
+}
+
+func TestRateLimitPermissionErrorIsNotRetried(t *testing.T) {
+	fake := newFakeApi(t, fakeResponse{status: http.StatusForbidden, body: `{"message":"Resource not accessible by integration"}`})
+
+	resp, err := (&http.Client{Transport: testTransport()}).Get(fake.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || fake.requests() != 1 {
+		t.Errorf("expected the permission error to be returned as is, got %d after %d requests", resp.StatusCode, fake.requests())
+	}
+
+	// the body is read to check for a secondary limit and has to be put back for the client
+	if !bytes.Contains(body, []byte("not accessible")) {
+		t.Errorf("expected the body to be readable, got %q", body)
+	}
+}
+
+func TestRateLimitRetryCap(t *testing.T) {
+	fake := newFakeApi(t, fakeResponse{status: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "0"}})
+
+	transport := testTransport()
+	transport.maxRetries = 2
+
+	resp, err := (&http.Client{Transport: transport}).Get(fake.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected the last rate limited response once the retries ran out, got %d", resp.StatusCode)
+	}
+
+	if fake.requests() != 3 {
+		t.Errorf("expected the first attempt and 2 retries, got %d requests", fake.requests())
+	}
+}
+
+func TestRateLimitReplaysBody(t *testing.T) {
+	fake := newFakeApi(t,
+		fakeResponse{status: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "0"}},
+		fakeResponse{status: http.StatusOK},
+	)
+
+	client := &http.Client{Transport: testTransport()}
+	if _, err := client.Post(fake.URL, "application/json", bytes.NewReader([]byte(`{"name":"repo"}`))); err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.requests() != 2 || fake.bodies[1] != `{"name":"repo"}` {
+		t.Errorf("expected the body to be sent again on the retry, got %q", fake.bodies)
+	}
+}
+
+func TestRateLimitDoesNotRetryUnreplayableBody(t *testing.T) {
+	fake := newFakeApi(t,
+		fakeResponse{status: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "0"}},
+		fakeResponse{status: http.StatusOK},
+	)
+
+	// a plain reader gives the request no GetBody so it can only be sent once
+	body := ioutil.NopCloser(bytes.NewReader([]byte(`{"name":"repo"}`)))
+	resp, err := (&http.Client{Transport: testTransport()}).Post(fake.URL, "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests || fake.requests() != 1 {
+		t.Errorf("expected the rate limited response without a retry, got %d after %d requests", resp.StatusCode, fake.requests())
+	}
+}
@@ -0,0 +1,110 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/util"
+	"github.com/google/go-github/v34/github"
+)
+
+const (
+	ReleaseMetaFile = "releases.json"
+)
+
+// ExportReleases will download the release metadata and every release asset for the repo
+//
+// assets are stored in a directory per release id as tag names can contain slashes
+func ExportReleases(cfg *config.Config, repo *source.Repository, logger *log.Logger) error {
+	var releases []*github.RepositoryRelease
+
+	ctx := context.Background()
+	client := githubClient(cfg)
+	releasePath := cfg.Path.ReleasePath(repo)
+
+	opt := &github.ListOptions{PerPage: 100}
+
+	for {
+		page, resp, err := client.Repositories.ListReleases(ctx, repo.Owner, repo.Name, opt)
+		if err != nil {
+			return err
+		}
+
+		releases = append(releases, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+
+		opt.Page = resp.NextPage
+	}
+
+	// the sizes are recorded up front so a repo that no longer has any releases stops counting them
+	sizes := config.LastExportSizes(cfg, repo)
+	sizes.Releases = 0
+	for _, release := range releases {
+		for _, asset := range release.Assets {
+			sizes.Releases += int64(asset.GetSize())
+		}
+	}
+
+	config.RecordExportSizes(cfg, repo, sizes)
+
+	if len(releases) == 0 {
+		return nil
+	}
+
+	for _, release := range releases {
+		for _, asset := range release.Assets {
+			logger.Printf("downloading release asset %s/%s\n", release.GetTagName(), asset.GetName())
+
+			assetPath := path.Join(releasePath, fmt.Sprint(release.GetID()), path.Base(asset.GetName()))
+			if err := downloadReleaseAsset(ctx, client, repo, asset, assetPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return util.WriteJson(path.Join(releasePath, ReleaseMetaFile), releases)
+}
+
+// downloadReleaseAsset will stream the asset binary to disk
+func downloadReleaseAsset(
+	ctx context.Context,
+	client *github.Client,
+	repo *source.Repository,
+	asset *github.ReleaseAsset,
+	assetPath string,
+) error {
+	// assets are served from a redirect to storage that does not need (or want) our auth headers
+	reader, _, err := client.Repositories.DownloadReleaseAsset(
+		ctx,
+		repo.Owner,
+		repo.Name,
+		asset.GetID(),
+		http.DefaultClient,
+	)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err = os.MkdirAll(path.Dir(assetPath), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(assetPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	return err
+}
@@ -0,0 +1,524 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/util"
+	"github.com/google/go-github/v34/github"
+)
+
+const (
+	// RepoMetadataVersion should be bumped whenever the structure of repoMetadata changes
+	RepoMetadataVersion = 2
+
+	RepoMetadataFile = "metadata.json"
+)
+
+// repoMetadata holds the settings needed to recreate a repo around its git data
+//
+// the go-github client has no support for rulesets, environments or variables so those are kept as
+// the raw api responses
+type repoMetadata struct {
+	Version          int
+	CreatedAt        time.Time
+	Repository       *github.Repository
+	BranchProtection map[string]*github.Protection
+	Rulesets         []json.RawMessage
+	Environments     []json.RawMessage
+	// custom deployment branch policies by environment name, added in version 2
+	BranchPolicies map[string][]branchPolicy `json:",omitempty"`
+	Variables      []actionsVariable
+	Secrets        []string
+}
+
+type actionsVariable struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// environment covers the parts of an environment response needed to recreate it
+type environment struct {
+	Name                   string            `json:"name"`
+	ProtectionRules        []environmentRule `json:"protection_rules"`
+	DeploymentBranchPolicy *json.RawMessage  `json:"deployment_branch_policy"`
+}
+
+// branchPolicy is a branch or tag pattern an environment can be deployed from
+type branchPolicy struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+type environmentRule struct {
+	Type      string `json:"type"`
+	WaitTimer *int   `json:"wait_timer"`
+	Reviewers []struct {
+		Type     string `json:"type"`
+		Reviewer struct {
+			ID int64 `json:"id"`
+		} `json:"reviewer"`
+	} `json:"reviewers"`
+}
+
+type environmentTarget struct {
+	Type string `json:"type"`
+	ID   int64  `json:"id"`
+}
+
+// ExportSettings will write the repo settings, branch protection, rulesets, environments and actions
+// variables to metadata.json in the repos meta dir
+//
+// actions secrets can not be read so only their names are kept
+func ExportSettings(cfg *config.Config, repo *source.Repository, logger *log.Logger) error {
+	var err error
+
+	ctx := context.Background()
+	client := githubClient(cfg)
+	owner := repo.Owner
+	name := repo.Name
+
+	metadata := &repoMetadata{
+		Version:          RepoMetadataVersion,
+		CreatedAt:        time.Now(),
+		BranchProtection: make(map[string]*github.Protection),
+	}
+
+	// the listing does not include everything (merge options) so we need the full repo
+	if metadata.Repository, _, err = client.Repositories.Get(ctx, owner, name); err != nil {
+		return err
+	}
+
+	opt := &github.BranchListOptions{
+		Protected:   github.Bool(true),
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	var branches []*github.Branch
+	err = paginate(&opt.ListOptions, func() (*github.Response, error) {
+		page, resp, err := client.Repositories.ListBranches(ctx, owner, name, opt)
+		branches = append(branches, page...)
+
+		return resp, err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, branch := range branches {
+		protection, _, err := client.Repositories.GetBranchProtection(ctx, owner, name, branch.GetName())
+		if err != nil {
+			if hasStatus(err, http.StatusForbidden, http.StatusNotFound) {
+				continue
+			}
+
+			return err
+		}
+
+		metadata.BranchProtection[branch.GetName()] = protection
+	}
+
+	if metadata.Rulesets, err = exportRulesets(ctx, client, owner, name); err != nil {
+		return err
+	}
+
+	for page := 1; page != 0; {
+		var environments struct {
+			Environments []json.RawMessage `json:"environments"`
+		}
+
+		url := fmt.Sprintf("repos/%s/%s/environments?per_page=100&page=%d", owner, name, page)
+		if page, err = getRaw(ctx, client, url, &environments); err != nil {
+			return err
+		}
+
+		metadata.Environments = append(metadata.Environments, environments.Environments...)
+	}
+
+	metadata.BranchPolicies = make(map[string][]branchPolicy)
+	for _, data := range metadata.Environments {
+		var env environment
+		if err = json.Unmarshal(data, &env); err != nil {
+			return err
+		}
+
+		if metadata.BranchPolicies[env.Name], err = exportBranchPolicies(ctx, client, owner, name, env); err != nil {
+			return err
+		}
+	}
+
+	// the variables endpoint caps the page size at 30
+	for page := 1; page != 0; {
+		var variables struct {
+			Variables []actionsVariable `json:"variables"`
+		}
+
+		url := fmt.Sprintf("repos/%s/%s/actions/variables?per_page=30&page=%d", owner, name, page)
+		if page, err = getRaw(ctx, client, url, &variables); err != nil {
+			return err
+		}
+
+		metadata.Variables = append(metadata.Variables, variables.Variables...)
+	}
+
+	secretOpt := &github.ListOptions{PerPage: 100}
+	err = paginate(secretOpt, func() (*github.Response, error) {
+		secrets, resp, err := client.Actions.ListRepoSecrets(ctx, owner, name, secretOpt)
+		if secrets != nil {
+			for _, secret := range secrets.Secrets {
+				metadata.Secrets = append(metadata.Secrets, secret.Name)
+			}
+		}
+
+		return resp, err
+	})
+
+	if err != nil && !hasStatus(err, http.StatusForbidden, http.StatusNotFound) {
+		return err
+	}
+
+	return util.WriteJson(path.Join(cfg.Path.MetaPath(repo), RepoMetadataFile), metadata)
+}
+
+// RestoreSettings will re-apply the settings from a metadata.json export to a recreated repo
+//
+// the git data needs to have been pushed first so that the default and protected branches exist,
+// secrets can not be restored so their names are logged for someone to set them by hand
+func RestoreSettings(cfg *config.Config, metadataPath, owner, name string, logger *log.Logger) error {
+	ctx := context.Background()
+	client := githubClient(cfg)
+
+	metadata := &repoMetadata{}
+	if err := util.ReadJson(metadataPath, metadata); err != nil {
+		return err
+	}
+
+	if metadata.Version > RepoMetadataVersion {
+		return fmt.Errorf("metadata version %d is newer than supported version %d", metadata.Version, RepoMetadataVersion)
+	}
+
+	saved := metadata.Repository
+	logger.Println("restoring repo settings")
+
+	// visibility covers private and internal, sending private as well conflicts for internal repos
+	edit := &github.Repository{
+		Description:         saved.Description,
+		Homepage:            saved.Homepage,
+		DefaultBranch:       saved.DefaultBranch,
+		Visibility:          saved.Visibility,
+		HasIssues:           saved.HasIssues,
+		HasWiki:             saved.HasWiki,
+		HasProjects:         saved.HasProjects,
+		IsTemplate:          saved.IsTemplate,
+		AllowMergeCommit:    saved.AllowMergeCommit,
+		AllowSquashMerge:    saved.AllowSquashMerge,
+		AllowRebaseMerge:    saved.AllowRebaseMerge,
+		DeleteBranchOnMerge: saved.DeleteBranchOnMerge,
+	}
+
+	// the visibility is only missing from exports of servers that don't support it
+	if saved.GetVisibility() == "" {
+		edit.Private = saved.Private
+	}
+
+	_, _, err := client.Repositories.Edit(ctx, owner, name, edit)
+
+	if err != nil {
+		return err
+	}
+
+	if _, _, err = client.Repositories.ReplaceAllTopics(ctx, owner, name, saved.Topics); err != nil {
+		return err
+	}
+
+	for branch, protection := range metadata.BranchProtection {
+		logger.Printf("restoring branch protection for %s\n", branch)
+		if _, _, err = client.Repositories.UpdateBranchProtection(ctx, owner, name, branch, protectionRequest(protection)); err != nil {
+			return err
+		}
+	}
+
+	for _, ruleset := range metadata.Rulesets {
+		if err = restoreRuleset(ctx, client, owner, name, ruleset); err != nil {
+			return err
+		}
+	}
+
+	for _, data := range metadata.Environments {
+		if err = restoreEnvironment(ctx, client, owner, name, data, metadata.BranchPolicies, logger); err != nil {
+			return err
+		}
+	}
+
+	for _, variable := range metadata.Variables {
+		logger.Printf("restoring actions variable %s\n", variable.Name)
+		if err = sendRaw(ctx, client, http.MethodPost, fmt.Sprintf("repos/%s/%s/actions/variables", owner, name), variable); err != nil {
+			return err
+		}
+	}
+
+	for _, secret := range metadata.Secrets {
+		logger.Printf("actions secret %s needs to be set manually\n", secret)
+	}
+
+	// archived repos are read only so this has to be done last
+	if saved.GetArchived() {
+		logger.Println("archiving repo")
+		_, _, err = client.Repositories.Edit(ctx, owner, name, &github.Repository{Archived: github.Bool(true)})
+	}
+
+	return err
+}
+
+// exportRulesets will fetch the full details of every ruleset on the repo
+//
+// the list endpoint only returns a summary so each ruleset has to be fetched individually
+func exportRulesets(ctx context.Context, client *github.Client, owner, name string) ([]json.RawMessage, error) {
+	var summaries []struct {
+		ID int64 `json:"id"`
+	}
+
+	for page := 1; page != 0; {
+		var pageSummaries []struct {
+			ID int64 `json:"id"`
+		}
+
+		var err error
+		url := fmt.Sprintf("repos/%s/%s/rulesets?per_page=100&includes_parents=false&page=%d", owner, name, page)
+		if page, err = getRaw(ctx, client, url, &pageSummaries); err != nil {
+			return nil, err
+		}
+
+		summaries = append(summaries, pageSummaries...)
+	}
+
+	var rulesets []json.RawMessage
+	for _, summary := range summaries {
+		var ruleset json.RawMessage
+		if _, err := getRaw(ctx, client, fmt.Sprintf("repos/%s/%s/rulesets/%d", owner, name, summary.ID), &ruleset); err != nil {
+			return nil, err
+		}
+
+		rulesets = append(rulesets, ruleset)
+	}
+
+	return rulesets, nil
+}
+
+// restoreRuleset will create the ruleset on the repo after removing the read only fields
+func restoreRuleset(ctx context.Context, client *github.Client, owner, name string, data json.RawMessage) error {
+	var ruleset map[string]interface{}
+	if err := json.Unmarshal(data, &ruleset); err != nil {
+		return err
+	}
+
+	for _, field := range []string{"id", "node_id", "source", "source_type", "_links", "created_at", "updated_at", "current_user_can_bypass"} {
+		delete(ruleset, field)
+	}
+
+	return sendRaw(ctx, client, http.MethodPost, fmt.Sprintf("repos/%s/%s/rulesets", owner, name), ruleset)
+}
+
+// exportBranchPolicies will fetch the custom branch and tag patterns of an environment that uses them
+func exportBranchPolicies(ctx context.Context, client *github.Client, owner, name string, env environment) ([]branchPolicy, error) {
+	var deploymentPolicy struct {
+		CustomBranchPolicies bool `json:"custom_branch_policies"`
+	}
+
+	if env.DeploymentBranchPolicy == nil {
+		return nil, nil
+	}
+
+	if err := json.Unmarshal(*env.DeploymentBranchPolicy, &deploymentPolicy); err != nil || !deploymentPolicy.CustomBranchPolicies {
+		return nil, err
+	}
+
+	var policies []branchPolicy
+	for page := 1; page != 0; {
+		var response struct {
+			BranchPolicies []branchPolicy `json:"branch_policies"`
+		}
+
+		var err error
+		endpoint := fmt.Sprintf(
+			"repos/%s/%s/environments/%s/deployment-branch-policies?per_page=100&page=%d",
+			owner,
+			name,
+			url.PathEscape(env.Name),
+			page,
+		)
+
+		if page, err = getRaw(ctx, client, endpoint, &response); err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, response.BranchPolicies...)
+	}
+
+	return policies, nil
+}
+
+// restoreEnvironment will create the environment along with its protection rules and custom branch policies
+func restoreEnvironment(
+	ctx context.Context,
+	client *github.Client,
+	owner string,
+	name string,
+	data json.RawMessage,
+	branchPolicies map[string][]branchPolicy,
+	logger *log.Logger,
+) error {
+	var env environment
+	if err := json.Unmarshal(data, &env); err != nil {
+		return err
+	}
+
+	logger.Printf("restoring environment %s\n", env.Name)
+
+	request := map[string]interface{}{
+		"deployment_branch_policy": env.DeploymentBranchPolicy,
+	}
+
+	for _, rule := range env.ProtectionRules {
+		switch rule.Type {
+		case "wait_timer":
+			request["wait_timer"] = rule.WaitTimer
+		case "required_reviewers":
+			var reviewers []environmentTarget
+			for _, reviewer := range rule.Reviewers {
+				reviewers = append(reviewers, environmentTarget{Type: reviewer.Type, ID: reviewer.Reviewer.ID})
+			}
+
+			request["reviewers"] = reviewers
+		}
+	}
+
+	envPath := fmt.Sprintf("repos/%s/%s/environments/%s", owner, name, url.PathEscape(env.Name))
+	if err := sendRaw(ctx, client, http.MethodPut, envPath, request); err != nil {
+		return err
+	}
+
+	// the policies can only be added once the environment exists with custom policies turned on
+	for _, policy := range branchPolicies[env.Name] {
+		logger.Printf("restoring deployment branch policy %s for %s\n", policy.Name, env.Name)
+		if err := sendRaw(ctx, client, http.MethodPost, envPath+"/deployment-branch-policies", policy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// protectionRequest converts an exported branch protection into the request needed to re-apply it
+func protectionRequest(protection *github.Protection) *github.ProtectionRequest {
+	request := &github.ProtectionRequest{
+		RequiredStatusChecks: protection.RequiredStatusChecks,
+	}
+
+	if protection.EnforceAdmins != nil {
+		request.EnforceAdmins = protection.EnforceAdmins.Enabled
+	}
+
+	if protection.RequireLinearHistory != nil {
+		request.RequireLinearHistory = github.Bool(protection.RequireLinearHistory.Enabled)
+	}
+
+	if protection.AllowForcePushes != nil {
+		request.AllowForcePushes = github.Bool(protection.AllowForcePushes.Enabled)
+	}
+
+	if protection.AllowDeletions != nil {
+		request.AllowDeletions = github.Bool(protection.AllowDeletions.Enabled)
+	}
+
+	if reviews := protection.RequiredPullRequestReviews; reviews != nil {
+		request.RequiredPullRequestReviews = &github.PullRequestReviewsEnforcementRequest{
+			DismissStaleReviews:          reviews.DismissStaleReviews,
+			RequireCodeOwnerReviews:      reviews.RequireCodeOwnerReviews,
+			RequiredApprovingReviewCount: reviews.RequiredApprovingReviewCount,
+		}
+
+		if reviews.DismissalRestrictions != nil {
+			users, teams := userLogins(reviews.DismissalRestrictions.Users), teamSlugs(reviews.DismissalRestrictions.Teams)
+			request.RequiredPullRequestReviews.DismissalRestrictionsRequest = &github.DismissalRestrictionsRequest{
+				Users: &users,
+				Teams: &teams,
+			}
+		}
+	}
+
+	if restrictions := protection.Restrictions; restrictions != nil {
+		request.Restrictions = &github.BranchRestrictionsRequest{
+			Users: userLogins(restrictions.Users),
+			Teams: teamSlugs(restrictions.Teams),
+		}
+
+		for _, app := range restrictions.Apps {
+			request.Restrictions.Apps = append(request.Restrictions.Apps, app.GetSlug())
+		}
+	}
+
+	return request
+}
+
+// userLogins maps users to their logins, the api requires an empty list rather than null
+func userLogins(users []*github.User) []string {
+	logins := []string{}
+	for _, user := range users {
+		logins = append(logins, user.GetLogin())
+	}
+
+	return logins
+}
+
+// teamSlugs maps teams to their slugs, the api requires an empty list rather than null
+func teamSlugs(teams []*github.Team) []string {
+	slugs := []string{}
+	for _, team := range teams {
+		slugs = append(slugs, team.GetSlug())
+	}
+
+	return slugs
+}
+
+// getRaw makes a request to an endpoint that the go-github client does not support, returning the
+// next page number (0 when there are no more pages)
+//
+// endpoints that are unavailable to the user or on the current plan are left empty
+func getRaw(ctx context.Context, client *github.Client, url string, target interface{}) (int, error) {
+	request, err := client.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(ctx, request, target)
+	if err != nil {
+		if hasStatus(err, http.StatusForbidden, http.StatusNotFound) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	return resp.NextPage, nil
+}
+
+// sendRaw sends a request with a body to an endpoint that the go-github client does not support
+func sendRaw(ctx context.Context, client *github.Client, method, url string, body interface{}) error {
+	request, err := client.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Do(ctx, request, nil)
+	return err
+}
@@ -0,0 +1,253 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/service/clone"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/source/filter"
+	"github.com/aceviralltd/github-backup/internal/util"
+)
+
+const (
+	// repos are kept in their own namespace so they can't collide with the github org repos
+	Namespace = "gitlab"
+
+	ProjectMetaFile = "project.json"
+)
+
+// gitlab accepts tokens of any type as the password for this user over https
+const tokenUser = "oauth2"
+
+// project covers the parts of the api response needed by the pipeline
+type project struct {
+	ID                int64           `json:"id"`
+	PathWithNamespace string          `json:"path_with_namespace"`
+	Description       string          `json:"description"`
+	DefaultBranch     string          `json:"default_branch"`
+	Visibility        string          `json:"visibility"`
+	HttpUrlToRepo     string          `json:"http_url_to_repo"`
+	SshUrlToRepo      string          `json:"ssh_url_to_repo"`
+	Topics            []string        `json:"topics"`
+	TagList           []string        `json:"tag_list"`
+	ForkedFrom        json.RawMessage `json:"forked_from_project"`
+	Archived          bool            `json:"archived"`
+	WikiEnabled       bool            `json:"wiki_enabled"`
+	EmptyRepo         bool            `json:"empty_repo"`
+	LastActivityAt    time.Time       `json:"last_activity_at"`
+	UpdatedAt         time.Time       `json:"updated_at"`
+	Namespace         struct {
+		FullPath string `json:"full_path"`
+	} `json:"namespace"`
+	Statistics struct {
+		RepositorySize int64 `json:"repository_size"`
+	} `json:"statistics"`
+}
+
+// Source lists and backs up the projects of the configured gitlab groups
+type Source struct {
+	cfg    *config.Config
+	filter *filter.Filter
+	client *http.Client
+}
+
+// NewSource will create the gitlab source, validating the repo filters on the way
+func NewSource(cfg *config.Config) (*Source, error) {
+	repoFilter, err := filter.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{cfg: cfg, filter: repoFilter, client: &http.Client{}}, nil
+}
+
+// Name identifies the source in logs
+func (s *Source) Name() string {
+	return Namespace
+}
+
+// ListRepos will return the projects in the configured groups (including subgroups) along with the
+// individually configured projects that pass the filters
+//
+// a project that is listed more than once (a group and its subgroup are both configured) is only
+// returned the first time
+func (s *Source) ListRepos() ([]*source.Repository, error) {
+	var repoList []*source.Repository
+	seen := make(map[int64]bool)
+
+	add := func(raw json.RawMessage) error {
+		repo, id, err := repository(raw)
+		if err != nil {
+			return err
+		}
+
+		if !seen[id] && s.filter.Match(repo) {
+			repoList = append(repoList, repo)
+		}
+		seen[id] = true
+
+		return nil
+	}
+
+	for _, group := range s.cfg.Gitlab.Groups {
+		endpoint := fmt.Sprintf(
+			"groups/%s/projects?include_subgroups=true&statistics=true&per_page=100",
+			url.PathEscape(group),
+		)
+
+		err := s.paginate(endpoint, func(page []json.RawMessage) error {
+			for _, raw := range page {
+				if err := add(raw); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to list group %s: %w", group, err)
+		}
+	}
+
+	for _, projectPath := range s.cfg.Gitlab.Projects {
+		var raw json.RawMessage
+
+		if _, err := s.get(fmt.Sprintf("projects/%s?statistics=true", url.PathEscape(projectPath)), &raw); err != nil {
+			return nil, fmt.Errorf("failed to get project %s: %w", projectPath, err)
+		}
+
+		if err := add(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	return repoList, nil
+}
+
+// Download will clone the project along with its wiki (if it has one)
+func (s *Source) Download(ctx context.Context, repo *source.Repository, logger *log.Logger) error {
+	return clone.Repo(ctx, s.cfg, repo, clone.Options{
+		Protocol: s.cfg.Gitlab.Protocol,
+		Username: tokenUser,
+		Password: s.cfg.Gitlab.Token,
+		Ssh:      s.cfg.Gitlab.Ssh,
+		Wikis:    s.cfg.Gitlab.Wikis,
+		Lfs:      s.cfg.Gitlab.Lfs,
+	}, logger)
+}
+
+// Export will write the full project response to the repos meta dir when settings are exported
+func (s *Source) Export(repo *source.Repository, logger *log.Logger) error {
+	if !s.cfg.Export.Settings {
+		return nil
+	}
+
+	logger.Println("exporting project")
+	return util.WriteJson(path.Join(s.cfg.Path.MetaPath(repo), ProjectMetaFile), repo.Native)
+}
+
+// paginate will call handle with each page of results until gitlab stops sending a next page
+func (s *Source) paginate(endpoint string, handle func([]json.RawMessage) error) error {
+	separator := "?"
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+
+	for page := "1"; page != ""; {
+		var results []json.RawMessage
+
+		headers, err := s.get(endpoint+separator+"page="+page, &results)
+		if err != nil {
+			return err
+		}
+
+		if err = handle(results); err != nil {
+			return err
+		}
+
+		page = headers.Get("X-Next-Page")
+	}
+
+	return nil
+}
+
+// get will make an authenticated request to the v4 api and decode the response into target
+func (s *Source) get(endpoint string, target interface{}) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, s.cfg.Gitlab.BaseUrl+"/api/v4/"+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cfg.Gitlab.Token != "" {
+		req.Header.Set("PRIVATE-TOKEN", s.cfg.Gitlab.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gitlab responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp.Header, json.Unmarshal(body, target)
+}
+
+// repository converts the api response into the details needed by the pipeline
+//
+// the raw response is kept as the native repo so nothing is lost from the project export
+func repository(raw json.RawMessage) (*source.Repository, int64, error) {
+	var p project
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, 0, err
+	}
+
+	// topics replaced tag_list in gitlab 14
+	topics := p.Topics
+	if len(topics) == 0 {
+		topics = p.TagList
+	}
+
+	// gitlab has no pushed_at, the last activity covers pushes along with issues etc
+	updatedAt := p.UpdatedAt
+	if updatedAt.IsZero() {
+		updatedAt = p.LastActivityAt
+	}
+
+	return &source.Repository{
+		Name:          path.Join(Namespace, p.PathWithNamespace),
+		Owner:         p.Namespace.FullPath,
+		Description:   p.Description,
+		CloneURL:      p.HttpUrlToRepo,
+		SSHURL:        p.SshUrlToRepo,
+		DefaultBranch: p.DefaultBranch,
+		Visibility:    p.Visibility,
+		Topics:        topics,
+		Fork:          len(p.ForkedFrom) > 0 && string(p.ForkedFrom) != "null",
+		Archived:      p.Archived,
+		HasWiki:       p.WikiEnabled,
+		Empty:         p.EmptyRepo,
+		Size:          int(p.Statistics.RepositorySize / 1024),
+		PushedAt:      p.LastActivityAt,
+		UpdatedAt:     updatedAt,
+		Native:        raw,
+	}, p.ID, nil
+}
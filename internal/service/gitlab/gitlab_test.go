@@ -0,0 +1,275 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+)
+
+const testToken = "glpat-test"
+
+// fakeGitlab serves the group and project endpoints of the v4 api from a fixed set of projects
+type fakeGitlab struct {
+	*httptest.Server
+
+	// projects by the full path of the group they are listed under, each page holds pageSize projects
+	groups   map[string][]map[string]interface{}
+	projects map[string]map[string]interface{}
+	pageSize int
+	// every request path that reached the api, with the page
+	requests []string
+}
+
+func newFakeGitlab(t *testing.T) *fakeGitlab {
+	fake := &fakeGitlab{
+		groups:   make(map[string][]map[string]interface{}),
+		projects: make(map[string]map[string]interface{}),
+		pageSize: 2,
+	}
+
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.Close)
+
+	return fake
+}
+
+func (f *fakeGitlab) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("PRIVATE-TOKEN") != testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"message":"401 Unauthorized"}`)
+		return
+	}
+
+	f.requests = append(f.requests, r.URL.EscapedPath()+"?page="+r.URL.Query().Get("page"))
+
+	const groupsPrefix = "/api/v4/groups/"
+	const projectsPrefix = "/api/v4/projects/"
+
+	switch escaped := r.URL.EscapedPath(); {
+	case strings.HasPrefix(escaped, groupsPrefix):
+		group := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, groupsPrefix), "/projects")
+		if r.URL.Query().Get("include_subgroups") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		projects, ok := f.groups[group]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"404 Group Not Found"}`)
+			return
+		}
+
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+
+		start := (page - 1) * f.pageSize
+		end := start + f.pageSize
+		if end >= len(projects) {
+			end = len(projects)
+		} else {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		}
+
+		if start > end {
+			start = end
+		}
+
+		json.NewEncoder(w).Encode(projects[start:end])
+	case strings.HasPrefix(escaped, projectsPrefix):
+		project, ok := f.projects[strings.TrimPrefix(r.URL.Path, projectsPrefix)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"404 Project Not Found"}`)
+			return
+		}
+
+		json.NewEncoder(w).Encode(project)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func testProject(id int, fullPath, namespace string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                  id,
+		"path_with_namespace": fullPath,
+		"visibility":          "private",
+		"http_url_to_repo":    "https://gitlab.example.com/" + fullPath + ".git",
+		"ssh_url_to_repo":     "git@gitlab.example.com:" + fullPath + ".git",
+		"last_activity_at":    "2021-06-01T10:00:00Z",
+		"updated_at":          "2021-06-02T10:00:00Z",
+		"namespace":           map[string]interface{}{"full_path": namespace},
+		"statistics":          map[string]interface{}{"repository_size": 2048},
+	}
+}
+
+func testSource(t *testing.T, baseUrl string) *Source {
+	cfg := &config.Config{}
+	cfg.Gitlab.BaseUrl = baseUrl
+	cfg.Gitlab.Token = testToken
+
+	src, err := NewSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return src
+}
+
+func repoNames(t *testing.T, src *Source) []string {
+	repos, err := src.ListRepos()
+	if err != nil {
+		t.Fatalf("failed to list repos: %s", err)
+	}
+
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func TestListReposPaginatesGroupsAndSubgroups(t *testing.T) {
+	fake := newFakeGitlab(t)
+
+	// the parent group includes the projects of its subgroup, as gitlab does with include_subgroups
+	fake.groups["acme/platform"] = []map[string]interface{}{
+		testProject(3, "acme/platform/deploy", "acme/platform"),
+		testProject(4, "acme/platform/infra", "acme/platform"),
+	}
+	fake.groups["acme"] = []map[string]interface{}{
+		testProject(1, "acme/api", "acme"),
+		testProject(2, "acme/web", "acme"),
+		testProject(3, "acme/platform/deploy", "acme/platform"),
+		testProject(4, "acme/platform/infra", "acme/platform"),
+		testProject(5, "acme/tools", "acme"),
+	}
+	fake.projects["other/standalone"] = testProject(6, "other/standalone", "other")
+	// listed again individually so it has to be deduplicated
+	fake.projects["acme/api"] = testProject(1, "acme/api", "acme")
+
+	src := testSource(t, fake.URL)
+	src.cfg.Gitlab.Groups = []string{"acme", "acme/platform"}
+	src.cfg.Gitlab.Projects = []string{"other/standalone", "acme/api"}
+
+	names := repoNames(t, src)
+	expected := []string{
+		"gitlab/acme/api",
+		"gitlab/acme/platform/deploy",
+		"gitlab/acme/platform/infra",
+		"gitlab/acme/tools",
+		"gitlab/acme/web",
+		"gitlab/other/standalone",
+	}
+
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	pages := 0
+	for _, request := range fake.requests {
+		if strings.HasPrefix(request, "/api/v4/groups/acme/projects?") {
+			pages++
+		}
+	}
+
+	if pages != 3 {
+		t.Errorf("expected the acme group to be fetched over 3 pages, got %d: %v", pages, fake.requests)
+	}
+
+	found := false
+	for _, request := range fake.requests {
+		if request == "/api/v4/groups/acme%2Fplatform/projects?page=1" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("expected the subgroup path to be escaped, got %v", fake.requests)
+	}
+}
+
+func TestListReposConvertsProjects(t *testing.T) {
+	fake := newFakeGitlab(t)
+	fake.groups["acme"] = []map[string]interface{}{testProject(1, "acme/api", "acme")}
+
+	src := testSource(t, fake.URL)
+	src.cfg.Gitlab.Groups = []string{"acme"}
+
+	repos, err := src.ListRepos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(repos) != 1 {
+		t.Fatalf("expected a single repo, got %d", len(repos))
+	}
+
+	repo := repos[0]
+	if repo.Owner != "acme" || repo.Visibility != "private" || repo.Size != 2 {
+		t.Errorf("unexpected repo details: %+v", repo)
+	}
+
+	if repo.CloneURL != "https://gitlab.example.com/acme/api.git" || repo.SSHURL != "git@gitlab.example.com:acme/api.git" {
+		t.Errorf("unexpected clone urls: %s %s", repo.CloneURL, repo.SSHURL)
+	}
+
+	if repo.PushedAt.Format("2006-01-02") != "2021-06-01" || repo.UpdatedAt.Format("2006-01-02") != "2021-06-02" {
+		t.Errorf("unexpected timestamps: %s %s", repo.PushedAt, repo.UpdatedAt)
+	}
+}
+
+func TestListReposSelfHostedBaseUrl(t *testing.T) {
+	fake := newFakeGitlab(t)
+	fake.groups["acme"] = []map[string]interface{}{testProject(1, "acme/api", "acme")}
+
+	// self hosted instances are often served from a sub path
+	mux := http.NewServeMux()
+	mux.Handle("/gitlab/", http.StripPrefix("/gitlab", fake.Server.Config.Handler))
+	selfHosted := httptest.NewServer(mux)
+	defer selfHosted.Close()
+
+	src := testSource(t, selfHosted.URL+"/gitlab")
+	src.cfg.Gitlab.Groups = []string{"acme"}
+
+	names := repoNames(t, src)
+	if len(names) != 1 || names[0] != "gitlab/acme/api" {
+		t.Errorf("expected the project from the self hosted instance, got %v", names)
+	}
+}
+
+func TestListReposRequiresToken(t *testing.T) {
+	fake := newFakeGitlab(t)
+	fake.groups["acme"] = []map[string]interface{}{testProject(1, "acme/api", "acme")}
+
+	src := testSource(t, fake.URL)
+	src.cfg.Gitlab.Token = "wrong"
+	src.cfg.Gitlab.Groups = []string{"acme"}
+
+	if _, err := src.ListRepos(); err == nil {
+		t.Fatal("expected listing to fail with an invalid token")
+	}
+}
+
+func TestListReposMissingGroup(t *testing.T) {
+	fake := newFakeGitlab(t)
+
+	src := testSource(t, fake.URL)
+	src.cfg.Gitlab.Groups = []string{"missing"}
+
+	if _, err := src.ListRepos(); err == nil {
+		t.Fatal("expected listing a missing group to fail")
+	}
+}
@@ -0,0 +1,525 @@
+package lfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	MediaType = "application/vnd.git-lfs+json"
+
+	// pointer files are never larger than this so there is no point reading anything bigger
+	MaxPointerSize = 1024
+	// maximum number of objects sent in a single batch request
+	BatchSize = 100
+)
+
+// Remote is an lfs server along with the credentials used to talk to it
+type Remote struct {
+	Endpoint string
+	Username string
+	Password string
+	// optional, cancels any request in flight when done
+	Context context.Context
+}
+
+// context for the requests to the remote
+func (r Remote) context() context.Context {
+	if r.Context == nil {
+		return context.Background()
+	}
+
+	return r.Context
+}
+
+// Pointer identifies a single lfs object
+type Pointer struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type batchRequest struct {
+	Operation string    `json:"operation"`
+	Transfers []string  `json:"transfers"`
+	Objects   []Pointer `json:"objects"`
+}
+
+type batchResponse struct {
+	Objects []batchObject `json:"objects"`
+}
+
+type batchObject struct {
+	Pointer
+	Actions map[string]batchAction `json:"actions"`
+	Error   *batchError            `json:"error"`
+}
+
+type batchAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+type batchError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Endpoint derives the lfs server url from a git remote url in the same way the git-lfs client does
+func Endpoint(remoteUrl string) string {
+	remoteUrl = strings.TrimSuffix(remoteUrl, "/")
+	if !strings.HasSuffix(remoteUrl, ".git") {
+		remoteUrl += ".git"
+	}
+
+	return remoteUrl + "/info/lfs"
+}
+
+// ObjectPath builds the location of an object within the git dir, this matches the layout used by
+// git-lfs so a restored repo can be used by the git-lfs client directly
+func ObjectPath(gitDir, oid string) string {
+	return path.Join(gitDir, "lfs", "objects", oid[0:2], oid[2:4], oid)
+}
+
+// UsesLfs checks the .gitattributes files at the tip of every ref for an lfs filter
+func UsesLfs(repo *git.Repository) (bool, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return false, err
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	found := false
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if found || ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		commit, err := refCommit(repo, ref.Hash())
+		if err != nil || seen[commit.TreeHash] {
+			return nil
+		}
+		seen[commit.TreeHash] = true
+
+		tree, err := commit.Tree()
+		if err != nil {
+			return err
+		}
+
+		found, err = treeUsesLfs(repo, tree)
+		return err
+	})
+
+	return found, err
+}
+
+// Pointers will scan every blob in the repo for lfs pointers, this covers the full history of all refs
+func Pointers(repo *git.Repository) ([]Pointer, error) {
+	var pointers []Pointer
+	seen := make(map[string]bool)
+
+	blobs, err := repo.BlobObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	err = blobs.ForEach(func(blob *object.Blob) error {
+		if blob.Size > MaxPointerSize {
+			return nil
+		}
+
+		reader, err := blob.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		pointer, ok := parsePointer(reader)
+		if ok && !seen[pointer.Oid] {
+			seen[pointer.Oid] = true
+			pointers = append(pointers, pointer)
+		}
+
+		return nil
+	})
+
+	return pointers, err
+}
+
+// Fetch will download every lfs object referenced in the repo into its lfs object store
+//
+// objects that are already stored are skipped, as are objects the server no longer has
+func Fetch(logger *log.Logger, repo *git.Repository, gitDir string, remote Remote) error {
+	pointers, err := Pointers(repo)
+	if err != nil {
+		return err
+	}
+
+	var missing []Pointer
+	for _, pointer := range pointers {
+		if stat, err := os.Stat(ObjectPath(gitDir, pointer.Oid)); err != nil || stat.Size() != pointer.Size {
+			missing = append(missing, pointer)
+		}
+	}
+
+	logger.Printf("fetching %d of %d lfs objects\n", len(missing), len(pointers))
+
+	for start := 0; start < len(missing); start += BatchSize {
+		end := start + BatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		response, err := batch(remote, "download", missing[start:end])
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range response.Objects {
+			if obj.Error != nil {
+				logger.Printf("lfs object %s unavailable: %s\n", obj.Oid, obj.Error.Message)
+				continue
+			}
+
+			action, ok := obj.Actions["download"]
+			if !ok {
+				continue
+			}
+
+			if err = downloadObject(remote, action, gitDir, obj.Pointer); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Push will upload every object in the lfs object store of the git dir to the remote
+//
+// this is used when restoring a backup, the git refs themselves still need to be pushed with git
+func Push(logger *log.Logger, gitDir string, remote Remote) error {
+	var pointers []Pointer
+
+	objectDir := path.Join(gitDir, "lfs", "objects")
+	err := filepath.Walk(objectDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || len(info.Name()) != sha256.Size*2 {
+			return err
+		}
+
+		pointers = append(pointers, Pointer{Oid: info.Name(), Size: info.Size()})
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("pushing %d lfs objects\n", len(pointers))
+
+	for start := 0; start < len(pointers); start += BatchSize {
+		end := start + BatchSize
+		if end > len(pointers) {
+			end = len(pointers)
+		}
+
+		response, err := batch(remote, "upload", pointers[start:end])
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range response.Objects {
+			if obj.Error != nil {
+				return fmt.Errorf("lfs object %s rejected: %s", obj.Oid, obj.Error.Message)
+			}
+
+			// no upload action means the server already has the object
+			action, ok := obj.Actions["upload"]
+			if !ok {
+				continue
+			}
+
+			if err = uploadObject(remote, action, gitDir, obj.Pointer); err != nil {
+				return err
+			}
+
+			if verify, ok := obj.Actions["verify"]; ok {
+				if err = verifyObject(remote, verify, obj.Pointer); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// refCommit resolves a ref hash to a commit, peeling annotated tags
+func refCommit(repo *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	if commit, err := repo.CommitObject(hash); err == nil {
+		return commit, nil
+	}
+
+	tag, err := repo.TagObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return tag.Commit()
+}
+
+// treeUsesLfs walks the tree looking for .gitattributes files that make use of the lfs filter
+func treeUsesLfs(repo *git.Repository, tree *object.Tree) (bool, error) {
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if path.Base(name) != ".gitattributes" || !entry.Mode.IsFile() {
+			continue
+		}
+
+		blob, err := repo.BlobObject(entry.Hash)
+		if err != nil {
+			return false, err
+		}
+
+		reader, err := blob.Reader()
+		if err != nil {
+			return false, err
+		}
+
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+
+		if err != nil {
+			return false, err
+		}
+
+		if bytes.Contains(data, []byte("filter=lfs")) {
+			return true, nil
+		}
+	}
+}
+
+// parsePointer will attempt to read the content of a blob as an lfs pointer
+func parsePointer(reader io.Reader) (Pointer, bool) {
+	var pointer Pointer
+
+	scanner := bufio.NewScanner(reader)
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "version https://git-lfs.github.com/spec/") {
+		return pointer, false
+	}
+
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "oid":
+			pointer.Oid = strings.TrimPrefix(parts[1], "sha256:")
+		case "size":
+			pointer.Size, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+	}
+
+	if _, err := hex.DecodeString(pointer.Oid); err != nil || len(pointer.Oid) != sha256.Size*2 {
+		return pointer, false
+	}
+
+	return pointer, true
+}
+
+// batch sends a request to the lfs batch api
+func batch(remote Remote, operation string, pointers []Pointer) (*batchResponse, error) {
+	body, err := json.Marshal(batchRequest{
+		Operation: operation,
+		Transfers: []string{"basic"},
+		Objects:   pointers,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(remote.context(), http.MethodPost, remote.Endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Accept", MediaType)
+	request.Header.Set("Content-Type", MediaType)
+	request.SetBasicAuth(remote.Username, remote.Password)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lfs batch %s failed with status %s", operation, response.Status)
+	}
+
+	result := &batchResponse{}
+	if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// downloadObject will fetch the object and store it in the git dir once its hash has been verified
+func downloadObject(remote Remote, action batchAction, gitDir string, pointer Pointer) error {
+	request, err := actionRequest(remote, action, http.MethodGet, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("lfs download of %s failed with status %s", pointer.Oid, response.Status)
+	}
+
+	tmpDir := path.Join(gitDir, "lfs", "tmp")
+	if err = os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(tmpDir, pointer.Oid)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, hash), response.Body)
+	tmpFile.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != pointer.Oid {
+		return errors.New("lfs object " + pointer.Oid + " failed hash verification")
+	}
+
+	objectPath := ObjectPath(gitDir, pointer.Oid)
+	if err = os.MkdirAll(path.Dir(objectPath), 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), objectPath)
+}
+
+// uploadObject sends the stored object to the location given by the batch api
+func uploadObject(remote Remote, action batchAction, gitDir string, pointer Pointer) error {
+	file, err := os.Open(ObjectPath(gitDir, pointer.Oid))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	request, err := actionRequest(remote, action, http.MethodPut, file)
+	if err != nil {
+		return err
+	}
+
+	request.ContentLength = pointer.Size
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("lfs upload of %s failed with status %s", pointer.Oid, response.Status)
+	}
+
+	return nil
+}
+
+// verifyObject lets the server know that an upload has completed
+func verifyObject(remote Remote, action batchAction, pointer Pointer) error {
+	body, err := json.Marshal(pointer)
+	if err != nil {
+		return err
+	}
+
+	request, err := actionRequest(remote, action, http.MethodPost, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Accept", MediaType)
+	request.Header.Set("Content-Type", MediaType)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("lfs verify of %s failed with status %s", pointer.Oid, response.Status)
+	}
+
+	return nil
+}
+
+// actionRequest builds a request for one of the actions returned by the batch api
+//
+// our credentials are only sent along when the action is on the lfs server itself and the action
+// has not given its own authorization, actions commonly point to pre-signed storage urls
+func actionRequest(remote Remote, action batchAction, method string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(remote.context(), method, action.Href, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range action.Header {
+		request.Header.Set(key, value)
+	}
+
+	endpoint, err := url.Parse(remote.Endpoint)
+	if err == nil && endpoint.Host == request.URL.Host && request.Header.Get("Authorization") == "" {
+		request.SetBasicAuth(remote.Username, remote.Password)
+	}
+
+	return request, nil
+}
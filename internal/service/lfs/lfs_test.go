@@ -0,0 +1,412 @@
+package lfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	testUsername = "backup"
+	testPassword = "secret"
+)
+
+// fakeServer is a stand in for the lfs batch api along with the basic transfer endpoints
+type fakeServer struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// objects held by the server keyed by oid
+	objects map[string][]byte
+	// objects the batch api reports an error for keyed by oid
+	broken map[string]int
+	// content served in place of the real object, used to break hash verification
+	corrupt map[string][]byte
+	// every oid requested through the batch api by operation
+	requested map[string][]string
+	uploaded  []string
+	verified  []string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	server := &fakeServer{
+		objects:   make(map[string][]byte),
+		broken:    make(map[string]int),
+		corrupt:   make(map[string][]byte),
+		requested: make(map[string][]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repo.git/info/lfs/objects/batch", server.batch)
+	mux.HandleFunc("/storage/", server.storage)
+	mux.HandleFunc("/verify/", server.verify)
+
+	server.Server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (s *fakeServer) remote() Remote {
+	return Remote{
+		Endpoint: Endpoint(s.URL + "/repo"),
+		Username: testUsername,
+		Password: testPassword,
+	}
+}
+
+func (s *fakeServer) authorized(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	return ok && username == testUsername && password == testPassword
+}
+
+func (s *fakeServer) batch(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != MediaType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var request batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := batchResponse{}
+	for _, pointer := range request.Objects {
+		s.requested[request.Operation] = append(s.requested[request.Operation], pointer.Oid)
+		obj := batchObject{Pointer: pointer}
+
+		if code, ok := s.broken[pointer.Oid]; ok {
+			obj.Error = &batchError{Code: code, Message: "object is broken"}
+			response.Objects = append(response.Objects, obj)
+			continue
+		}
+
+		_, stored := s.objects[pointer.Oid]
+		switch request.Operation {
+		case "download":
+			if stored {
+				obj.Actions = map[string]batchAction{
+					"download": {Href: s.URL + "/storage/" + pointer.Oid},
+				}
+			} else {
+				obj.Error = &batchError{Code: http.StatusNotFound, Message: "object does not exist"}
+			}
+		case "upload":
+			if !stored {
+				obj.Actions = map[string]batchAction{
+					"upload": {Href: s.URL + "/storage/" + pointer.Oid},
+					"verify": {Href: s.URL + "/verify/" + pointer.Oid},
+				}
+			}
+		}
+
+		response.Objects = append(response.Objects, obj)
+	}
+
+	w.Header().Set("Content-Type", MediaType)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *fakeServer) storage(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	oid := path.Base(r.URL.Path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		content, ok := s.corrupt[oid]
+		if !ok {
+			content, ok = s.objects[oid]
+		}
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Write(content)
+	case http.MethodPut:
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.objects[oid] = content
+		s.uploaded = append(s.uploaded, oid)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeServer) verify(w http.ResponseWriter, r *http.Request) {
+	var pointer Pointer
+	if err := json.NewDecoder(r.Body).Decode(&pointer); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if content, ok := s.objects[pointer.Oid]; !ok || int64(len(content)) != pointer.Size {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.verified = append(s.verified, pointer.Oid)
+}
+
+func oidOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func pointerFile(content []byte) string {
+	return fmt.Sprintf(
+		"version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n",
+		oidOf(content),
+		len(content),
+	)
+}
+
+// lfsRepo creates a repo with a single commit containing an lfs pointer for each of the given objects
+func lfsRepo(t *testing.T, contents ...[]byte) (*git.Repository, string) {
+	dir := t.TempDir()
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{".gitattributes": "*.bin filter=lfs diff=lfs merge=lfs -text\n"}
+	for i, content := range contents {
+		files[fmt.Sprintf("object-%d.bin", i)] = pointerFile(content)
+	}
+
+	for name, content := range files {
+		if err = ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = worktree.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = worktree.Commit("add lfs objects", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return repo, path.Join(dir, ".git")
+}
+
+func storeObject(t *testing.T, gitDir string, content []byte) {
+	objectPath := ObjectPath(gitDir, oidOf(content))
+	if err := os.MkdirAll(path.Dir(objectPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(objectPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testLogger() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestUsesLfs(t *testing.T) {
+	repo, _ := lfsRepo(t, []byte("first object"))
+
+	uses, err := UsesLfs(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !uses {
+		t.Error("expected the .gitattributes lfs filter to be found")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	server := newFakeServer(t)
+
+	available := []byte("available object")
+	stored := []byte("already stored object")
+	missing := []byte("object the server lost")
+	broken := []byte("object with a batch error")
+
+	server.objects[oidOf(available)] = available
+	server.objects[oidOf(stored)] = stored
+	server.objects[oidOf(broken)] = broken
+	server.broken[oidOf(broken)] = http.StatusUnprocessableEntity
+
+	repo, gitDir := lfsRepo(t, available, stored, missing, broken)
+	storeObject(t, gitDir, stored)
+
+	if err := Fetch(testLogger(), repo, gitDir, server.remote()); err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(ObjectPath(gitDir, oidOf(available)))
+	if err != nil {
+		t.Fatalf("available object was not downloaded: %s", err)
+	}
+
+	if !bytes.Equal(content, available) {
+		t.Errorf("downloaded object content mismatch: %q", content)
+	}
+
+	if contains(server.requested["download"], oidOf(stored)) {
+		t.Error("object that was already stored was requested from the server")
+	}
+
+	for _, content := range [][]byte{missing, broken} {
+		if _, err = os.Stat(ObjectPath(gitDir, oidOf(content))); !os.IsNotExist(err) {
+			t.Errorf("object %s with a batch error should not be stored", oidOf(content))
+		}
+	}
+}
+
+func TestFetchRejectsHashMismatch(t *testing.T) {
+	server := newFakeServer(t)
+
+	content := []byte("genuine object")
+	server.objects[oidOf(content)] = content
+	server.corrupt[oidOf(content)] = []byte("tampered object")
+
+	repo, gitDir := lfsRepo(t, content)
+
+	err := Fetch(testLogger(), repo, gitDir, server.remote())
+	if err == nil || !strings.Contains(err.Error(), "hash verification") {
+		t.Fatalf("expected a hash verification error, got %v", err)
+	}
+
+	if _, err = os.Stat(ObjectPath(gitDir, oidOf(content))); !os.IsNotExist(err) {
+		t.Error("object that failed verification should not be stored")
+	}
+}
+
+func TestFetchUnauthorized(t *testing.T) {
+	server := newFakeServer(t)
+	repo, gitDir := lfsRepo(t, []byte("some object"))
+
+	remote := server.remote()
+	remote.Password = "wrong"
+
+	if err := Fetch(testLogger(), repo, gitDir, remote); err == nil {
+		t.Fatal("expected the batch request to fail without valid credentials")
+	}
+}
+
+func TestPush(t *testing.T) {
+	server := newFakeServer(t)
+
+	local := []byte("object only held locally")
+	shared := []byte("object the server already has")
+	server.objects[oidOf(shared)] = shared
+
+	gitDir := t.TempDir()
+	storeObject(t, gitDir, local)
+	storeObject(t, gitDir, shared)
+
+	if err := Push(testLogger(), gitDir, server.remote()); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+
+	if !bytes.Equal(server.objects[oidOf(local)], local) {
+		t.Error("local object was not uploaded")
+	}
+
+	if len(server.uploaded) != 1 || server.uploaded[0] != oidOf(local) {
+		t.Errorf("expected only the local object to be uploaded, got %v", server.uploaded)
+	}
+
+	if len(server.verified) != 1 || server.verified[0] != oidOf(local) {
+		t.Errorf("expected the uploaded object to be verified, got %v", server.verified)
+	}
+}
+
+func TestPushRejectedObject(t *testing.T) {
+	server := newFakeServer(t)
+
+	content := []byte("object the server refuses")
+	server.broken[oidOf(content)] = http.StatusUnprocessableEntity
+
+	gitDir := t.TempDir()
+	storeObject(t, gitDir, content)
+
+	err := Push(testLogger(), gitDir, server.remote())
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected the rejected object to fail the push, got %v", err)
+	}
+
+	if len(server.uploaded) != 0 {
+		t.Errorf("rejected object should not be uploaded, got %v", server.uploaded)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/org/repo":      "https://github.com/org/repo.git/info/lfs",
+		"https://github.com/org/repo.git":  "https://github.com/org/repo.git/info/lfs",
+		"https://github.com/org/repo.git/": "https://github.com/org/repo.git/info/lfs",
+	}
+
+	for remote, expected := range tests {
+		if actual := Endpoint(remote); actual != expected {
+			t.Errorf("Endpoint(%q) = %q, expected %q", remote, actual, expected)
+		}
+	}
+}
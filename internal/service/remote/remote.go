@@ -0,0 +1,89 @@
+package remote
+
+import (
+	"context"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/service/clone"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/source/filter"
+)
+
+// repos are kept in their own namespace so they can't collide with the github org repos
+const Namespace = "git"
+
+// Source backs up the remotes listed in the [[source.git]] sections of the config
+//
+// there is no api to ask so every remote is always listed and nothing is exported alongside them
+type Source struct {
+	cfg    *config.Config
+	filter *filter.Filter
+}
+
+// NewSource will create the git remote source, validating the repo filters on the way
+func NewSource(cfg *config.Config) (*Source, error) {
+	repoFilter, err := filter.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{cfg: cfg, filter: repoFilter}, nil
+}
+
+// Name identifies the source in logs
+func (s *Source) Name() string {
+	return Namespace
+}
+
+// ListRepos will return the configured remotes that pass the name filters
+//
+// without an api there is no way to know when a remote was last pushed to, so they are always
+// treated as changed and never skipped as unchanged. The visibility, topic, size, fork, archived and
+// pushed filters are not applied as there is nothing to check them against, a remote is listed
+// explicitly so only the include/exclude name patterns can leave it out
+func (s *Source) ListRepos() ([]*source.Repository, error) {
+	var repoList []*source.Repository
+	now := time.Now()
+
+	for i := range s.cfg.Source.Git {
+		remote := &s.cfg.Source.Git[i]
+
+		repo := &source.Repository{
+			Name:      path.Join(Namespace, remote.Name),
+			CloneURL:  remote.Url,
+			PushedAt:  now,
+			UpdatedAt: now,
+			Native:    remote,
+		}
+
+		if s.filter.MatchName(repo) {
+			repoList = append(repoList, repo)
+		}
+	}
+
+	return repoList, nil
+}
+
+// Download will clone the remote with its own credentials
+func (s *Source) Download(ctx context.Context, repo *source.Repository, logger *log.Logger) error {
+	remote := repo.Native.(*config.GitRemoteConfig)
+
+	// the url is cloned as given, ssh urls are picked up from their scheme
+	return clone.Repo(ctx, s.cfg, repo, clone.Options{
+		Protocol: config.ProtocolHttps,
+		Username: remote.Username,
+		Password: remote.Password(),
+		Ssh:      remote.Ssh,
+		// lfs is fetched from the https endpoint derived from the clone url
+		Lfs: remote.Lfs && strings.HasPrefix(remote.Url, "http"),
+	}, logger)
+}
+
+// Export has nothing to do for plain git remotes
+func (s *Source) Export(repo *source.Repository, logger *log.Logger) error {
+	return nil
+}
@@ -0,0 +1,210 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/source"
+)
+
+// Filter decides which of the listed repos should be included in the backup
+type Filter struct {
+	cfg *config.Config
+
+	include      []namePattern
+	exclude      []namePattern
+	pushedAfter  time.Time
+	pushedBefore time.Time
+}
+
+// namePattern is either a glob or a regex pattern for matching against repo names
+type namePattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+// match the pattern against the given repo name
+func (p namePattern) match(name string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(name)
+	}
+
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+// New will validate the filter config and compile any patterns it contains
+func New(cfg *config.Config) (*Filter, error) {
+	var err error
+	filter := &Filter{cfg: cfg}
+
+	if filter.include, err = compileNamePatterns(cfg.Filter.Include); err != nil {
+		return nil, err
+	}
+
+	if filter.exclude, err = compileNamePatterns(cfg.Filter.Exclude); err != nil {
+		return nil, err
+	}
+
+	if filter.pushedAfter, err = parseFilterTime(cfg.Filter.PushedAfter); err != nil {
+		return nil, err
+	}
+
+	if filter.pushedBefore, err = parseFilterTime(cfg.Filter.PushedBefore); err != nil {
+		return nil, err
+	}
+
+	for _, mode := range []string{cfg.Filter.Forks, cfg.Filter.Archived} {
+		switch mode {
+		case "", config.FilterInclude, config.FilterExclude, config.FilterOnly:
+		default:
+			return nil, fmt.Errorf("invalid filter mode %q, expected include, exclude or only", mode)
+		}
+	}
+
+	return filter, nil
+}
+
+// Match checks the repo against every configured filter
+func (f *Filter) Match(repo *source.Repository) bool {
+	filter := f.cfg.Filter
+
+	if !f.MatchName(repo) {
+		return false
+	}
+
+	if !matchMode(filter.Forks, repo.Fork) || !matchMode(filter.Archived, repo.Archived) {
+		return false
+	}
+
+	if len(filter.Topics) > 0 && !containsAny(filter.Topics, repo.Topics) {
+		return false
+	}
+
+	if containsAny(filter.ExcludeTopics, repo.Topics) {
+		return false
+	}
+
+	if len(filter.Visibility) > 0 && !containsAny(filter.Visibility, []string{repo.Visibility}) {
+		return false
+	}
+
+	if len(filter.Languages) > 0 && !containsAny(filter.Languages, []string{repo.Language}) {
+		return false
+	}
+
+	if filter.MinSize > 0 && repo.Size < filter.MinSize {
+		return false
+	}
+
+	if filter.MaxSize > 0 && repo.Size > filter.MaxSize {
+		return false
+	}
+
+	if !f.pushedAfter.IsZero() && repo.PushedAt.Before(f.pushedAfter) {
+		return false
+	}
+
+	if !f.pushedBefore.IsZero() && repo.PushedAt.After(f.pushedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// MatchName only checks the repo name against the include and exclude patterns
+//
+// this is for sources that know nothing about their repos beyond a name and url, the other filters
+// would otherwise drop them based on metadata they don't have
+func (f *Filter) MatchName(repo *source.Repository) bool {
+	if len(f.include) > 0 && !matchAnyPattern(f.include, repo.Name) {
+		return false
+	}
+
+	return !matchAnyPattern(f.exclude, repo.Name)
+}
+
+// compileNamePatterns will convert the patterns given in the config into matchers
+//
+// patterns wrapped in slashes are treated as regex, everything else is a glob
+func compileNamePatterns(patterns []string) ([]namePattern, error) {
+	var compiled []namePattern
+
+	for _, pattern := range patterns {
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			regex, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, err
+			}
+
+			compiled = append(compiled, namePattern{regex: regex})
+			continue
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q: %w", pattern, err)
+		}
+
+		compiled = append(compiled, namePattern{glob: pattern})
+	}
+
+	return compiled, nil
+}
+
+// parseFilterTime accepts either a date or a duration counting back from now
+func parseFilterTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if date, err := time.Parse(config.DefaultDateFormat, value); err == nil {
+		return date, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid filter date %q, expected 2006-01-02 or a duration", value)
+	}
+
+	return time.Now().Add(-duration), nil
+}
+
+// matchAnyPattern checks the name against a list of patterns
+func matchAnyPattern(patterns []namePattern, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.match(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchMode applies an include/exclude/only filter mode to a repo flag
+func matchMode(mode string, flag bool) bool {
+	switch mode {
+	case config.FilterExclude:
+		return !flag
+	case config.FilterOnly:
+		return flag
+	default:
+		return true
+	}
+}
+
+// containsAny does a case insensitive check for any of the wanted values in the list
+func containsAny(wanted, values []string) bool {
+	for _, want := range wanted {
+		for _, value := range values {
+			if strings.EqualFold(want, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,50 @@
+package source
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Repository is the provider neutral description of a repo to back up
+type Repository struct {
+	// unique name of the repo within the backup, this is used for the archive and state paths so repos
+	// from anywhere other than the github org are namespaced (gists/..., gitlab/...)
+	Name          string
+	Owner         string
+	Description   string
+	CloneURL      string
+	SSHURL        string
+	DefaultBranch string
+	Visibility    string
+	// primary language, not every provider reports this
+	Language string
+	Topics   []string
+	Fork     bool
+	Archived bool
+	HasWiki  bool
+	// the repo has no commits so there is nothing to clone
+	Empty bool
+	// size in KB
+	Size      int
+	PushedAt  time.Time
+	UpdatedAt time.Time
+
+	// the providers own representation of the repo for use by its provider specific exports
+	Native interface{}
+}
+
+// Source is a provider that repos can be listed and backed up from
+//
+// every source shares the same clone, archive and upload stages, they only differ in how repos are
+// found and what extra data is exported alongside them
+type Source interface {
+	// Name identifies the source in logs
+	Name() string
+	// ListRepos returns every repo selected for backup
+	ListRepos() ([]*Repository, error)
+	// Download clones the repo (and its wiki) into the repo path, giving up when the context is done
+	Download(ctx context.Context, repo *Repository, logger *log.Logger) error
+	// Export writes any provider specific data (issues, releases etc) into the repos meta dirs
+	Export(repo *Repository, logger *log.Logger) error
+}
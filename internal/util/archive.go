@@ -1,55 +1,207 @@
 package util
 
 import (
-	"archive/zip"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/aceviralltd/github-backup/internal/config"
-
-	"github.com/google/go-github/v34/github"
+	"github.com/aceviralltd/github-backup/internal/source"
 )
 
-// ArchiveDirectory will archive and the remove the given directory
-func ArchiveDirectory(cfg *config.Config, repo *github.Repository) (string, error) {
-	archivePath := cfg.Path.ArchivePath(repo)
-	directoryPath := cfg.Path.RepoPath(repo)
+// Archive is one of the archives made for a repo along with the paths it holds
+type Archive struct {
+	// where the archive is staged when it is written to disk before the upload
+	Path string
+	// added to the repo name for the description of the separate archives (.releases, .actions)
+	Suffix string
+	Paths  []string
+}
 
-	file, err := os.Create(archivePath)
-	if err != nil {
-		panic(err)
+// RepoArchives works out the archives to make for the repo, the first is always the repo archive itself
+// which holds the repo (or its bundles) along with the wiki and exported provider data (if any)
+//
+// release assets that exceed the configured split size and the actions export are given their own archive
+func RepoArchives(cfg *config.Config, repo *source.Repository) ([]Archive, error) {
+	directoryPaths := []string{cfg.Path.RepoPath(repo)}
+	extraPaths := []string{cfg.Path.WikiPath(repo), cfg.Path.MetaPath(repo)}
+
+	// bundles don't carry lfs objects so those are archived from the repo alongside them
+	if cfg.Archive.Bundle {
+		directoryPaths = nil
+		extraPaths = []string{
+			cfg.Path.BundlePath(repo),
+			cfg.Path.WikiBundlePath(repo),
+			path.Join(cfg.Path.RepoPath(repo), "lfs"),
+			cfg.Path.BundleChainPath(repo),
+			cfg.Path.MetaPath(repo),
+		}
 	}
-	defer file.Close()
 
-	zipper := zip.NewWriter(file)
-	defer zipper.Close()
+	var separate []Archive
 
-	err = filepath.Walk(directoryPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return err
+	actionsPath := cfg.Path.ActionsPath(repo)
+	if _, err := os.Stat(actionsPath); err == nil {
+		separate = append(separate, Archive{cfg.Path.ActionsArchivePath(repo), ".actions", []string{actionsPath}})
+	}
+
+	// the wiki and exported github data are kept alongside the repo so they can share the same archive
+	for _, extraPath := range extraPaths {
+		if _, err := os.Stat(extraPath); err == nil {
+			directoryPaths = append(directoryPaths, extraPath)
 		}
+	}
 
-		file, err := os.Open(path)
+	releasePath := cfg.Path.ReleasePath(repo)
+	if _, err := os.Stat(releasePath); err == nil {
+		size, err := directorySize(releasePath)
 		if err != nil {
+			return nil, err
+		}
+
+		if size > cfg.Export.ReleaseSplitBytes() {
+			separate = append(separate, Archive{cfg.Path.ReleaseArchivePath(repo), ".releases", []string{releasePath}})
+		} else {
+			directoryPaths = append(directoryPaths, releasePath)
+		}
+	}
+
+	return append([]Archive{{cfg.Path.ArchivePath(repo), "", directoryPaths}}, separate...), nil
+}
+
+// ArchiveDirectory will stage the archives of the repo on disk (in the configured format) and then remove
+// everything they hold, persistent mirrors are archived but left in place
+func ArchiveDirectory(cfg *config.Config, repo *source.Repository) (string, error) {
+	archives, err := RepoArchives(cfg, repo)
+	if err != nil {
+		return "", err
+	}
+
+	for i, archive := range archives {
+		if err = writeArchive(cfg, archive.Path, archive.Paths); err != nil {
+			for _, written := range archives[:i] {
+				os.RemoveAll(written.Path)
+			}
+
+			return "", err
+		}
+	}
+
+	RemoveArchived(cfg, repo, archives)
+	return archives[0].Path, nil
+}
+
+// RemoveArchived removes everything held by the archives of the repo once they are safely written (or
+// uploaded), persistent mirrors are left in place
+func RemoveArchived(cfg *config.Config, repo *source.Repository, archives []Archive) {
+	RemoveArchivePaths(cfg, archives)
+
+	// the bundled repos are no longer needed either
+	for _, repoPath := range []string{cfg.Path.RepoPath(repo), cfg.Path.WikiPath(repo)} {
+		if cfg.Archive.Bundle && !cfg.Path.IsMirror(repoPath) {
+			os.RemoveAll(repoPath)
+		}
+	}
+}
+
+// RemoveArchivePaths removes only the paths held by the given archives, the repo is left in place for
+// any of its other archives that still need to be written
+func RemoveArchivePaths(cfg *config.Config, archives []Archive) {
+	for _, archive := range archives {
+		for _, directoryPath := range archive.Paths {
+			if !cfg.Path.IsMirror(directoryPath) {
+				os.RemoveAll(directoryPath)
+			}
+		}
+	}
+}
+
+// WriteArchive will write an archive (in the configured format) holding every file in the given
+// directories to the output
+func WriteArchive(cfg *config.Config, output io.Writer, directoryPaths []string) error {
+	writer, err := newArchiveWriter(cfg.Archive.Format, cfg.Archive.Level, output)
+	if err != nil {
+		return err
+	}
+
+	for _, directoryPath := range directoryPaths {
+		if err = addDirectory(cfg, writer, directoryPath); err != nil {
+			writer.Close()
 			return err
 		}
-		defer file.Close()
+	}
+
+	return writer.Close()
+}
+
+// writeArchive will create an archive at the archive path containing every file in the given directories
+//
+// a failed archive is removed rather than being left behind for the upload to pick up
+func writeArchive(cfg *config.Config, archivePath string, directoryPaths []string) error {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+
+	if err = WriteArchive(cfg, file, directoryPaths); err != nil {
+		file.Close()
+		os.RemoveAll(archivePath)
+		return err
+	}
+
+	// the archive is only complete once the footer is written and flushed to disk
+	if err = file.Close(); err != nil {
+		os.RemoveAll(archivePath)
+		return err
+	}
+
+	return nil
+}
 
-		zipFile, err := zipper.Create(path)
+// addDirectory will walk the given directory adding each entry to the archive
+func addDirectory(cfg *config.Config, writer archiveWriter, directoryPath string) error {
+	return filepath.Walk(directoryPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		_, err = io.Copy(zipFile, file)
-		return err
+		return writer.add(archiveName(cfg, path), path, info)
 	})
+}
 
-	if err != nil {
-		os.RemoveAll(archivePath)
-		return "", err
+// archiveName is the name of the entry within the archive, paths are made relative to the download (or
+// mirror) dir so every entry sits under the repo name no matter where or when it was archived
+func archiveName(cfg *config.Config, entryPath string) string {
+	root := cfg.Path.DownloadPath()
+	if cfg.Path.IsMirror(entryPath) {
+		root = cfg.Path.MirrorDir
+	}
+
+	name, err := filepath.Rel(root, entryPath)
+	if err != nil || strings.HasPrefix(name, "..") {
+		name = filepath.Base(entryPath)
 	}
 
-	os.RemoveAll(directoryPath)
-	return archivePath, nil
+	return filepath.ToSlash(name)
+}
+
+// directorySize totals up the size of all files in the directory
+func directorySize(directoryPath string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(directoryPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
 }
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// FreeSpace will find the number of bytes available to us on the filesystem holding dir
+func FreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	// blocks reserved for root are not counted, we can't use them
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// SameFilesystem checks if both dirs are on the same filesystem, so they share the same free space
+func SameFilesystem(a, b string) (bool, error) {
+	var statA, statB syscall.Stat_t
+	if err := syscall.Stat(a, &statA); err != nil {
+		return false, err
+	}
+
+	if err := syscall.Stat(b, &statB); err != nil {
+		return false, err
+	}
+
+	return statA.Dev == statB.Dev, nil
+}
+
+// FormatBytes will format a byte count for the logs
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,383 @@
+package util
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+// magic numbers at the start of each supported archive format
+var formatSignatures = []struct {
+	signature []byte
+	format    string
+}{
+	{[]byte("PK\x03\x04"), config.ArchiveZip},
+	{[]byte{0x1f, 0x8b}, config.ArchiveTarGz},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, config.ArchiveTarZst},
+}
+
+// DetectFormat works out the format of an archive from its contents rather than its name, downloads
+// from glacier don't keep the name they were uploaded with
+func DetectFormat(archivePath string) (string, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(file, header); err != nil {
+		return "", fmt.Errorf("failed to read archive header: %w", err)
+	}
+
+	for _, match := range formatSignatures {
+		if bytes.HasPrefix(header, match.signature) {
+			return match.format, nil
+		}
+	}
+
+	return "", errors.New("unrecognised archive format")
+}
+
+// ExtractArchive will extract an archive of any supported format into the destination, returning the
+// format it was found to be
+//
+// archives made before entries were named relative to the download dir hold the absolute path of each
+// entry, these are made relative to the first of the legacy roots (glob patterns for the dirs that were
+// archived from) they match so old and new archives extract to the same layout
+func ExtractArchive(archivePath, destination string, legacyRoots []string) (string, error) {
+	format, err := DetectFormat(archivePath)
+	if err != nil {
+		return "", err
+	}
+
+	// the entry paths are checked against the destination so it must be absolute with no symlinks in it
+	if err = os.MkdirAll(destination, os.ModePerm); err != nil {
+		return format, err
+	}
+
+	if destination, err = filepath.Abs(destination); err != nil {
+		return format, err
+	}
+
+	if destination, err = filepath.EvalSymlinks(destination); err != nil {
+		return format, err
+	}
+
+	if format == config.ArchiveZip {
+		return format, extractZip(archivePath, destination, legacyRoots)
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return format, err
+	}
+	defer file.Close()
+
+	var decompressor io.Reader
+	if format == config.ArchiveTarGz {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return format, err
+		}
+		defer gzipReader.Close()
+
+		decompressor = gzipReader
+	} else {
+		zstdReader, err := zstd.NewReader(file)
+		if err != nil {
+			return format, err
+		}
+		defer zstdReader.Close()
+
+		decompressor = zstdReader
+	}
+
+	return format, extractTar(tar.NewReader(decompressor), destination, legacyRoots)
+}
+
+// extractZip writes out the directories, files and symlinks in the zip
+func extractZip(archivePath, destination string, legacyRoots []string) error {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, zipFile := range reader.File {
+		target, err := extractPath(destination, legacyName(zipFile.Name, legacyRoots))
+		if err != nil {
+			return err
+		}
+
+		if zipFile.FileInfo().IsDir() {
+			if err = writeDir(destination, target, zipFile.Mode()); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err = extractZipFile(zipFile, destination, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractZipFile writes out a single file or symlink from the zip
+func extractZipFile(zipFile *zip.File, destination, target string) error {
+	content, err := zipFile.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if zipFile.Mode()&os.ModeSymlink == 0 {
+		return writeFile(destination, target, content, zipFile.Mode())
+	}
+
+	link, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	return writeSymlink(destination, target, string(link))
+}
+
+// extractTar writes out the directories, files and symlinks in the tar
+func extractTar(reader *tar.Reader, destination string, legacyRoots []string) error {
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		target, err := extractPath(destination, legacyName(header.Name, legacyRoots))
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = writeDir(destination, target, os.FileMode(header.Mode))
+		case tar.TypeReg:
+			err = writeFile(destination, target, reader, os.FileMode(header.Mode))
+		case tar.TypeSymlink:
+			err = writeSymlink(destination, target, header.Linkname)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// legacyName makes the absolute entry names of old archives relative to the matching legacy root,
+// names that match none of them keep their full path beneath the destination
+func legacyName(name string, legacyRoots []string) string {
+	if !strings.HasPrefix(name, "/") {
+		return name
+	}
+
+	segments := strings.Split(strings.Trim(name, "/"), "/")
+	for _, root := range legacyRoots {
+		rootSegments := strings.Split(strings.Trim(root, "/"), "/")
+		if root == "" || len(rootSegments) >= len(segments) {
+			continue
+		}
+
+		// the patterns are matched against the same number of leading segments as they have
+		prefix := strings.Join(segments[:len(rootSegments)], "/")
+		if matched, _ := path.Match(strings.Join(rootSegments, "/"), prefix); matched {
+			return strings.Join(segments[len(rootSegments):], "/")
+		}
+	}
+
+	return strings.TrimPrefix(name, "/")
+}
+
+// extractPath joins the entry name onto the destination making sure it can't escape it
+func extractPath(destination, name string) (string, error) {
+	target := filepath.Join(destination, filepath.FromSlash(name))
+	if !withinDestination(destination, target) {
+		return "", fmt.Errorf("archive entry %s is outside of the destination", name)
+	}
+
+	return target, nil
+}
+
+// withinDestination checks the target is the destination or somewhere below it
+func withinDestination(destination, target string) bool {
+	return target == destination || strings.HasPrefix(target, destination+string(os.PathSeparator))
+}
+
+// resolvePath follows the elements from the (already resolved) start one at a time in the same way as
+// the filesystem would, so that symlinks extracted earlier can't be used to step outside the destination
+//
+// elements that don't exist yet are taken as they are, stepping back out of one with .. is refused as
+// a later entry could create it as a symlink and change where the path leads
+func resolvePath(start string, elements []string) (string, error) {
+	current := start
+	missing := false
+
+	for _, element := range elements {
+		switch element {
+		case "", ".":
+			continue
+		case "..":
+			if missing {
+				return "", errors.New("path steps back out of a directory that does not exist")
+			}
+
+			current = filepath.Dir(current)
+			continue
+		}
+
+		current = filepath.Join(current, element)
+		if missing {
+			continue
+		}
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			missing = true
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if current, err = filepath.EvalSymlinks(current); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return current, nil
+}
+
+// resolveEntry finds where the target really is on disk once any symlinks in its path are followed,
+// the target itself is only followed when asked as files and symlinks replace whatever is there
+func resolveEntry(destination, target string, followTarget bool) (string, error) {
+	relative, err := filepath.Rel(destination, target)
+	if err != nil {
+		return "", err
+	} else if relative == "." && !followTarget {
+		return "", errors.New("archive entry replaces the destination")
+	}
+
+	elements := strings.Split(relative, string(os.PathSeparator))
+	if !followTarget {
+		elements = elements[:len(elements)-1]
+	}
+
+	resolved, err := resolvePath(destination, elements)
+	if err != nil || !withinDestination(destination, resolved) {
+		return "", fmt.Errorf("archive entry %s resolves outside of the destination", relative)
+	}
+
+	if !followTarget {
+		resolved = filepath.Join(resolved, filepath.Base(target))
+	}
+
+	return resolved, nil
+}
+
+// writeDir creates the directory, making sure it stays owner writable so its contents can be extracted
+func writeDir(destination, target string, mode os.FileMode) error {
+	resolved, err := resolveEntry(destination, target, true)
+	if err != nil {
+		return err
+	}
+
+	return os.MkdirAll(resolved, mode.Perm()|0700)
+}
+
+// writeFile will write the content to the target with the given permissions
+//
+// a symlink already at the target is replaced rather than written through
+func writeFile(destination, target string, content io.Reader, mode os.FileMode) error {
+	resolved, err := resolveEntry(destination, target, false)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(resolved), os.ModePerm); err != nil {
+		return err
+	}
+
+	if info, err := os.Lstat(resolved); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err = os.Remove(resolved); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(resolved, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// writeSymlink creates the link as long as it leads somewhere within the destination when followed
+// through the links that already exist
+//
+// directories and links to somewhere else are never replaced, doing so would change where any link
+// that passes through them leads after it has been checked
+func writeSymlink(destination, target, link string) error {
+	if filepath.IsAbs(link) {
+		return fmt.Errorf("symlink %s points outside of the destination", link)
+	}
+
+	resolved, err := resolveEntry(destination, target, false)
+	if err != nil {
+		return err
+	}
+
+	linked, err := resolvePath(filepath.Dir(resolved), strings.Split(filepath.FromSlash(link), string(os.PathSeparator)))
+	if err != nil || !withinDestination(destination, linked) {
+		return fmt.Errorf("symlink %s points outside of the destination", link)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(resolved), os.ModePerm); err != nil {
+		return err
+	}
+
+	if info, err := os.Lstat(resolved); err == nil {
+		if existing, _ := os.Readlink(resolved); existing == link {
+			return nil
+		}
+
+		if info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("symlink %s would replace an existing directory or symlink", target)
+		}
+
+		if err = os.Remove(resolved); err != nil {
+			return err
+		}
+	}
+
+	return os.Symlink(link, resolved)
+}
@@ -0,0 +1,190 @@
+package util
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is a single entry of a test archive, a link makes it a symlink and a nil body a directory
+type tarEntry struct {
+	name string
+	link string
+	body []byte
+}
+
+func writeTestTar(t *testing.T, entries []tarEntry) string {
+	archivePath := filepath.Join(t.TempDir(), "test.tar.gz")
+
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	compressor := gzip.NewWriter(file)
+	writer := tar.NewWriter(compressor)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644}
+
+		switch {
+		case entry.link != "":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.link
+		case entry.body == nil:
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(entry.body))
+		}
+
+		if err = writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = writer.Write(entry.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return archivePath
+}
+
+// extractTestTar extracts the entries into a destination within a parent dir, the parent is returned
+// so anything written outside of the destination can be found
+func extractTestTar(t *testing.T, entries []tarEntry) (string, string, error) {
+	parent := t.TempDir()
+	destination := filepath.Join(parent, "restore")
+
+	_, err := ExtractArchive(writeTestTar(t, entries), destination, nil)
+	return parent, destination, err
+}
+
+func assertNotExist(t *testing.T, filePath string) {
+	if _, err := os.Lstat(filePath); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to exist", filePath)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	_, destination, err := extractTestTar(t, []tarEntry{
+		{name: "org/repo/"},
+		{name: "org/repo/HEAD", body: []byte("ref: refs/heads/main\n")},
+		{name: "org/repo/current", link: "HEAD"},
+		{name: "org/repo/up", link: ".."},
+		{name: "org/repo/up/sibling.txt", body: []byte("sibling")},
+	})
+
+	if err != nil {
+		t.Fatalf("extract failed: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(destination, "org/repo/current"))
+	if err != nil || string(content) != "ref: refs/heads/main\n" {
+		t.Errorf("expected the symlink to lead to HEAD, got %q (%v)", content, err)
+	}
+
+	// writing through a symlink that stays within the destination is fine
+	if _, err = os.Stat(filepath.Join(destination, "org/sibling.txt")); err != nil {
+		t.Errorf("expected the file written through the symlink to exist: %s", err)
+	}
+}
+
+func TestExtractArchiveRefusesEscapes(t *testing.T) {
+	tests := map[string][]tarEntry{
+		"relative name": {
+			{name: "../escape.txt", body: []byte("escaped")},
+		},
+		"absolute symlink": {
+			{name: "link", link: "/tmp"},
+		},
+		"relative symlink": {
+			{name: "a/link", link: "../../escape"},
+		},
+		"symlink chain": {
+			{name: "a/"},
+			{name: "a/up", link: ".."},
+			{name: "a/x", link: "up/.."},
+			{name: "a/x/escape.txt", body: []byte("escaped")},
+		},
+		"symlink through a missing dir": {
+			{name: "a/x", link: "b/../.."},
+			{name: "a/b", link: ".."},
+		},
+		"replaced symlink": {
+			{name: "a/"},
+			{name: "a/sub/"},
+			{name: "a/up", link: "sub"},
+			{name: "a/x", link: "up/../.."},
+			{name: "a/up", link: ".."},
+		},
+	}
+
+	for name, entries := range tests {
+		parent, _, err := extractTestTar(t, entries)
+		if err == nil {
+			t.Errorf("%s: expected the extract to be refused", name)
+		}
+
+		assertNotExist(t, filepath.Join(parent, "escape.txt"))
+	}
+}
+
+func TestExtractArchiveExistingSymlinks(t *testing.T) {
+	parent := t.TempDir()
+	outside := filepath.Join(parent, "outside")
+	destination := filepath.Join(parent, "restore")
+
+	for _, dir := range []string{outside, destination} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(outside, "config"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// links left in the destination from elsewhere must not be written through
+	if err := os.Symlink(outside, filepath.Join(destination, "dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(filepath.Join(outside, "config"), filepath.Join(destination, "config")); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := writeTestTar(t, []tarEntry{{name: "dir/config", body: []byte("replaced")}})
+	if _, err := ExtractArchive(archivePath, destination, nil); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("expected writing through the existing symlink to be refused, got %v", err)
+	}
+
+	archivePath = writeTestTar(t, []tarEntry{{name: "config", body: []byte("replaced")}})
+	if _, err := ExtractArchive(archivePath, destination, nil); err != nil {
+		t.Fatalf("extract failed: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(outside, "config"))
+	if err != nil || string(content) != "original" {
+		t.Errorf("expected the file outside the destination to be untouched, got %q (%v)", content, err)
+	}
+
+	info, err := os.Lstat(filepath.Join(destination, "config"))
+	if err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("expected the symlink to be replaced by the extracted file")
+	}
+}
@@ -0,0 +1,171 @@
+package util
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveWriter adds the entries found while walking a directory to an archive under the given name
+type archiveWriter interface {
+	add(name, path string, info os.FileInfo) error
+	Close() error
+}
+
+// newArchiveWriter will create a writer for the given format, a level of 0 uses the formats default
+func newArchiveWriter(format string, level int, output io.Writer) (archiveWriter, error) {
+	switch format {
+	case config.ArchiveZip:
+		zipper := zip.NewWriter(output)
+		if level != 0 {
+			zipper.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+				return flate.NewWriter(out, level)
+			})
+		}
+
+		return &zipWriter{zipper}, nil
+
+	case config.ArchiveTarGz:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		compressor, err := gzip.NewWriterLevel(output, level)
+		if err != nil {
+			return nil, err
+		}
+
+		return &tarWriter{tar.NewWriter(compressor), compressor}, nil
+
+	case config.ArchiveTarZst:
+		var options []zstd.EOption
+		if level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+
+		compressor, err := zstd.NewWriter(output, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &tarWriter{tar.NewWriter(compressor), compressor}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported archive format %s", format)
+}
+
+// zipWriter stores directories, regular files and symlinks along with their modes, symlinks are
+// stored as a file holding the link target as the zip and unzip tools do
+type zipWriter struct {
+	zipper *zip.Writer
+}
+
+func (w *zipWriter) add(name, path string, info os.FileInfo) error {
+	if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+		// sockets, pipes and devices have no place in a backup
+		return nil
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	if info.IsDir() {
+		// directories are kept so empty ones are restored
+		header.Name += "/"
+		header.Method = zip.Store
+	} else {
+		header.Method = zip.Deflate
+	}
+
+	zipFile, err := w.zipper.CreateHeader(header)
+	if err != nil || info.IsDir() {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(zipFile, link)
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(zipFile, file)
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zipper.Close()
+}
+
+// tarWriter stores directories, regular files and symlinks along with their modes
+type tarWriter struct {
+	archive    *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (w *tarWriter) add(name, path string, info os.FileInfo) error {
+	var link string
+	var err error
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	case !info.IsDir() && !info.Mode().IsRegular():
+		// sockets, pipes and devices have no place in a backup
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err = w.archive.WriteHeader(header); err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w.archive, file)
+	return err
+}
+
+// Close will flush the tar footer before the compressed stream is closed
+func (w *tarWriter) Close() error {
+	if err := w.archive.Close(); err != nil {
+		w.compressor.Close()
+		return err
+	}
+
+	return w.compressor.Close()
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// WriteJson will marshal the data to an indented json file, creating the parent dir if needed
+func WriteJson(filePath string, data interface{}) error {
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filePath, encoded, 0644)
+}
+
+// ReadJson will unmarshal the given file into target
+func ReadJson(filePath string, target interface{}) error {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, target)
+}
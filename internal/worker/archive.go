@@ -2,12 +2,15 @@ package worker
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path"
 
 	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/service/bundle"
+	"github.com/aceviralltd/github-backup/internal/source"
 	"github.com/aceviralltd/github-backup/internal/util"
-	"github.com/google/go-github/v34/github"
 )
 
 // InitializeArchiveWorker will setup then env for and start the archiver goroutine
@@ -24,28 +27,34 @@ func InitializeArchiveWorker(cfg *config.Config, bufferSize int) {
 // archiveWorker handles the archiving of repos
 func archiveWorker(logger *log.Logger, cfg *config.Config) {
 	for entry := range ArciveQueue {
-		if cfg.Github.SkipArchived && *entry.Repo.Archived {
-			logger.Printf("skipping archived repo: %s", *entry.Repo.Name)
-		}
+		progress := config.RunProgress(entry.Repo.Name, config.ProgressEntry{Downloaded: true})
 
-		progress, ok := config.CurrentRunProgress[*entry.Repo.Name]
-		if !ok {
-			progress = &config.ProgressEntry{
-				Downloaded: true,
-				Archived:   false,
-				Uploaded:   false,
+		if cfg.Archive.Bundle {
+			logger.Println("bundling", entry.Repo.Name)
+			if err := bundleRepo(logger, cfg, entry); err != nil {
+				recordFailure(logger, entry.Repo, cfg, progress, entry.Description, "Failed to bundle repo", err)
+				finishEntry()
+				continue
 			}
 		}
 
-		logger.Println("archiving", *entry.Repo.Name)
+		// the archive is written straight into the upload by the glacier worker
+		if cfg.Archive.Stream {
+			enqueueGlacierUpload(logger, progress, entry)
+			continue
+		}
+
+		logger.Println("archiving", entry.Repo.Name)
 		if _, err := util.ArchiveDirectory(cfg, entry.Repo); err != nil {
-			logger.Println("archive failed", err)
-			util.WriteToLog(cfg, "", entry.Description, errors.New("Failed to archive repo"))
-			return
+			recordFailure(logger, entry.Repo, cfg, progress, entry.Description, "Failed to archive repo", err)
+
+			// a full disk fails the archive, stopping here would leave every other repo stuck in the queue
+			finishEntry()
+			continue
 		}
 
 		progress.Archived = true
-		config.UpdateProgress(cfg, *entry.Repo.Name, *progress)
+		config.UpdateProgress(cfg, entry.Repo.Name, *progress)
 
 		enqueueGlacierUpload(logger, progress, entry)
 	}
@@ -57,12 +66,13 @@ func archiveWorker(logger *log.Logger, cfg *config.Config) {
 // enqueueArchive handles the zipping of the repo
 func enqueueArchive(
 	logger *log.Logger,
-	repo *github.Repository,
+	repo *source.Repository,
 	cfg *config.Config,
 	progress *config.ProgressEntry,
 	description string,
 ) {
 	entry := QueueEntry{repo, description}
+	startEntry()
 
 	if progress.Archived {
 		enqueueGlacierUpload(logger, progress, entry)
@@ -72,3 +82,125 @@ func enqueueArchive(
 	logger.Println("adding to archive queue")
 	ArciveQueue <- entry
 }
+
+// bundleRepo writes the repo and its wiki (if there is one) as git bundles ready to be archived
+//
+// in incremental mode the repo bundle only holds what changed since the last backup, wikis are
+// small enough that they are always bundled in full
+func bundleRepo(logger *log.Logger, cfg *config.Config, entry QueueEntry) error {
+	repoPath := cfg.Path.RepoPath(entry.Repo)
+	if _, err := os.Stat(repoPath); err == nil {
+		if cfg.Archive.Incremental {
+			err = createIncrementalBundle(logger, cfg, entry)
+		} else {
+			err = createBundle(logger, cfg, repoPath, cfg.Path.BundlePath(entry.Repo))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	wikiPath := cfg.Path.WikiPath(entry.Repo)
+	if _, err := os.Stat(wikiPath); err != nil {
+		return nil
+	}
+
+	return createBundle(logger, cfg, wikiPath, cfg.Path.WikiBundlePath(entry.Repo))
+}
+
+// createIncrementalBundle will bundle the objects added since the last bundle in the repos chain
+//
+// the new entry is kept as pending until the archive is uploaded, a copy of the chain is archived
+// alongside the bundle so it can be restored without the state dir
+func createIncrementalBundle(logger *log.Logger, cfg *config.Config, entry QueueEntry) error {
+	// a pending entry left by an earlier run that failed to upload must not be committed by this one
+	pendingPath := cfg.Path.RepoStatePath(entry.Repo, bundle.PendingChainFile)
+	if err := os.Remove(pendingPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	chain, err := bundle.LoadChain(cfg.Path.RepoStatePath(entry.Repo, bundle.ChainFile))
+	if err != nil {
+		return err
+	}
+
+	if chain.Rollover(cfg.Archive.MaxChain) {
+		logger.Println("bundle chain limit reached, starting a new full bundle")
+	}
+
+	bundlePath := cfg.Path.BundlePath(entry.Repo)
+	refs, prerequisites, err := bundle.CreateIncremental(cfg.Path.RepoPath(entry.Repo), bundlePath, chain.Tips())
+	if errors.Is(err, bundle.ErrNoRefs) {
+		// nothing changed since the last bundle, the archive still gets the chain so it can be restored
+		if len(chain.Entries) == 0 {
+			return nil
+		}
+
+		return chain.Save(cfg.Path.BundleChainPath(entry.Repo))
+	} else if err != nil {
+		os.Remove(bundlePath)
+		return err
+	}
+
+	chain.Add(path.Base(bundlePath), cfg.Aws.Vault, entry.Description, refs, prerequisites)
+
+	if err = chain.Save(pendingPath); err != nil {
+		return err
+	}
+
+	return chain.Save(cfg.Path.BundleChainPath(entry.Repo))
+}
+
+// commitBundleChain will make the pending chain entry the basis for the next incremental bundle once
+// its archive has been uploaded
+//
+// the pending entry has to be for the bundle of this run and the uploaded archive, anything else is
+// thrown away so the next run bundles from the last committed entry again
+func commitBundleChain(cfg *config.Config, entry QueueEntry, archiveId string) error {
+	pendingPath := cfg.Path.RepoStatePath(entry.Repo, bundle.PendingChainFile)
+	if _, err := os.Stat(pendingPath); err != nil {
+		return nil
+	}
+
+	chain, err := bundle.LoadChain(pendingPath)
+	if err != nil {
+		return err
+	}
+
+	if len(chain.Entries) == 0 {
+		return os.Remove(pendingPath)
+	}
+
+	pending := chain.Entries[len(chain.Entries)-1]
+	if pending.File != path.Base(cfg.Path.BundlePath(entry.Repo)) || pending.Description != entry.Description {
+		os.Remove(pendingPath)
+		return fmt.Errorf("pending bundle %s (%s) does not match the uploaded archive %s", pending.File, pending.Description, entry.Description)
+	}
+
+	pending.ArchiveId = archiveId
+
+	if err = chain.Save(cfg.Path.RepoStatePath(entry.Repo, bundle.ChainFile)); err != nil {
+		return err
+	}
+
+	return os.Remove(pendingPath)
+}
+
+// createBundle will bundle a single repo falling back to the git cli if needed
+//
+// repos without any refs are left out of the archive rather than writing an empty bundle
+func createBundle(logger *log.Logger, cfg *config.Config, repoPath, bundlePath string) error {
+	_, err := bundle.Create(repoPath, bundlePath)
+	if err == nil || errors.Is(err, bundle.ErrNoRefs) {
+		return nil
+	}
+
+	os.Remove(bundlePath)
+	if cfg.GitBin != "" {
+		logger.Printf("Failed with error: %s - Falling back to git bundle\n", err)
+		return bundle.CreateWithGit(cfg.GitBin, repoPath, bundlePath)
+	}
+
+	return err
+}
@@ -0,0 +1,63 @@
+package worker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/failure"
+	"github.com/aceviralltd/github-backup/internal/util"
+)
+
+const CatalogFileName = "catalog.json"
+
+// BackupCatalog will upload the run catalog so the current archive of every repo can be found from
+// the latest vault, including the repos that were skipped as unchanged
+//
+// this should only be called once the repo workers have finished
+func BackupCatalog(logger *log.Logger, cfg *config.Config) {
+	data, err := ioutil.ReadFile(cfg.Path.CatalogPath())
+	if err != nil {
+		return
+	}
+
+	// the uploaded file is removed so a copy is sent to keep the catalog in the state dir
+	uploadPath := path.Join(cfg.Path.DownloadPath(), CatalogFileName)
+	if err = ioutil.WriteFile(uploadPath, data, 0644); err != nil {
+		logger.Println("failed to copy run catalog: " + err.Error())
+		return
+	}
+
+	description := cfg.ArchiveDescription("catalog")
+
+	// the catalog is the only way to find the archives of unchanged repos so transient failures are
+	// retried in the same way as clones
+	for retry := 0; ; retry++ {
+		logger.Println("uploading run catalog")
+
+		archiveId, err := uploadArchive(logger, cfg, cfg.Aws.Vault, uploadPath, description)
+		if err == nil {
+			config.RecordCatalogUpload(cfg, config.ArchiveRecord{
+				Vault:       cfg.Aws.Vault,
+				ArchiveId:   archiveId,
+				Description: description,
+			})
+
+			return
+		}
+
+		category := failure.Classify(err)
+		if !category.Retryable() || retry >= cfg.Clone.Retries {
+			logger.Printf("Failed to upload run catalog (%s): %s\n", category, err)
+			util.WriteToLog(cfg, "", description, fmt.Errorf("Failed to upload run catalog (%s): %w", category, err))
+			return
+		}
+
+		delay := cfg.Clone.RetryDelayFor(retry + 1)
+		logger.Printf("catalog upload failed (%s), retrying in %s: %s\n", category, delay, err)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,242 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/util"
+)
+
+// number of repos queued for or being worked on by the archive and glacier workers, each of these
+// frees up its disk space once it has been uploaded
+var inFlight int64
+
+// diskEstimate is the space a repo will take up at its peak in the root dir and the mirror dir
+type diskEstimate struct {
+	root   int64
+	mirror int64
+	// false when the repo size is not listed (static git remotes), only the exports are counted
+	known bool
+}
+
+// PlanDiskSpace compares the space needed by the repos that will be downloaded this run against the free
+// space in the root dir, and the mirror dir when it is on a separate filesystem
+//
+// in abort mode an error is returned when they won't all fit at once, otherwise the downloads are left to
+// pause until space is freed by the uploads
+func PlanDiskSpace(logger *log.Logger, cfg *config.Config, repos []*source.Repository) error {
+	var total, mirrorTotal, largest int64
+	var largestRepo string
+	var unknown []string
+
+	for _, repo := range repos {
+		if progress := config.RunProgress(repo.Name, config.ProgressEntry{}); progress.Downloaded || progress.Uploaded {
+			continue
+		}
+
+		if _, ok := unchangedSinceBackup(cfg, repo); ok {
+			continue
+		}
+
+		estimate := estimatedSize(cfg, repo)
+		total += estimate.root
+		mirrorTotal += estimate.mirror
+
+		if !estimate.known {
+			unknown = append(unknown, repo.Name)
+		}
+
+		if estimate.root > largest {
+			largest, largestRepo = estimate.root, repo.Name
+		}
+	}
+
+	if len(unknown) > 0 {
+		logger.Printf("size of %d repos is unknown, they are left out of the estimate: %s\n", len(unknown), strings.Join(unknown, ", "))
+	}
+
+	dirs := []string{cfg.Path.RootDir}
+	if cfg.Path.MirrorDir != "" {
+		dirs = append(dirs, cfg.Path.MirrorDir)
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	// mirrors on the same filesystem as the root dir use up the same free space
+	if cfg.Path.MirrorDir != "" {
+		same, err := util.SameFilesystem(cfg.Path.RootDir, cfg.Path.MirrorDir)
+		if err != nil {
+			return fmt.Errorf("failed to check the filesystem of %s: %w", cfg.Path.MirrorDir, err)
+		}
+
+		if same {
+			total += mirrorTotal
+		} else if err = checkDiskSpace(logger, cfg, cfg.Path.MirrorDir, mirrorTotal); err != nil {
+			return err
+		}
+	}
+
+	if err := checkDiskSpace(logger, cfg, cfg.Path.RootDir, total); err != nil {
+		return err
+	}
+
+	free, err := util.FreeSpace(cfg.Path.RootDir)
+	if err == nil && largest+cfg.Disk.MinFreeBytes() > free {
+		logger.Printf("WARNING: %s needs %s and will fail unless space is freed\n", largestRepo, util.FormatBytes(largest))
+	}
+
+	return nil
+}
+
+// checkDiskSpace compares the space needed in the dir with its free space, only abort mode treats not
+// having enough as an error
+func checkDiskSpace(logger *log.Logger, cfg *config.Config, dir string, needed int64) error {
+	free, err := util.FreeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check free space in %s: %w", dir, err)
+	}
+
+	floor := cfg.Disk.MinFreeBytes()
+	logger.Printf(
+		"estimated %s needed for the run, %s free in %s (keeping %s free)\n",
+		util.FormatBytes(needed),
+		util.FormatBytes(free),
+		dir,
+		util.FormatBytes(floor),
+	)
+
+	if needed+floor <= free {
+		return nil
+	}
+
+	if cfg.Disk.Insufficient == config.DiskAbort {
+		return fmt.Errorf(
+			"not enough disk space in %s, %s needed but only %s is available above the %s floor",
+			dir,
+			util.FormatBytes(needed),
+			util.FormatBytes(free-floor),
+			util.FormatBytes(floor),
+		)
+	}
+
+	logger.Printf("not enough disk space in %s to hold every repo at once, downloads will pause until space is freed\n", dir)
+	return nil
+}
+
+// estimatedSize of the disk space the repo will take up at its peak
+//
+// the listed size is only that of the packed repo, the clone (unless it lives in the mirror dir), its
+// bundle and the archive (unless it is streamed) are all on disk together before the clone is removed.
+// At least one copy is always counted in the root dir for the wiki and exports that sit alongside it,
+// along with the release assets and artifacts from the last export of the repo.
+//
+// new mirrors need the full size in the mirror dir, existing ones only grow by what was pushed which
+// can't be known up front
+func estimatedSize(cfg *config.Config, repo *source.Repository) diskEstimate {
+	copies := int64(2)
+	if cfg.Path.MirrorDir != "" {
+		copies--
+	}
+
+	if cfg.Archive.Stream {
+		copies--
+	}
+
+	if cfg.Archive.Bundle {
+		copies++
+	}
+
+	if copies < 1 {
+		copies = 1
+	}
+
+	size := int64(repo.Size) * 1024
+	estimate := diskEstimate{root: size * copies, known: repo.Size > 0 || repo.Empty}
+
+	if cfg.Path.MirrorDir != "" {
+		if _, err := os.Stat(cfg.Path.RepoPath(repo)); err != nil {
+			estimate.mirror = size
+		}
+	}
+
+	// exports are archived separately so they are staged a second time unless streamed
+	exports := config.LastExportSizes(cfg, repo).Total()
+	if !cfg.Archive.Stream {
+		exports *= 2
+	}
+
+	estimate.root += exports
+	return estimate
+}
+
+// waitForSpace blocks the download of the repo while it would take the free space below the floor
+//
+// the wait is only worth it while the archive and glacier workers have repos that will free up space
+// once uploaded, with nothing left in flight the repo is given up on
+func waitForSpace(logger *log.Logger, cfg *config.Config, repo *source.Repository) error {
+	estimate := estimatedSize(cfg, repo)
+	if !estimate.known {
+		logger.Printf("size of %s is unknown, only checking the %s floor\n", repo.Name, util.FormatBytes(cfg.Disk.MinFreeBytes()))
+	}
+
+	needed := estimate.root + cfg.Disk.MinFreeBytes()
+	waiting := false
+
+	for {
+		free, err := util.FreeSpace(cfg.Path.RootDir)
+		if err != nil {
+			// not being able to check is no reason to stop the backup
+			logger.Printf("failed to check free space: %s\n", err)
+			return nil
+		}
+
+		if free >= needed {
+			if waiting {
+				logger.Println("disk space freed, resuming downloads")
+			}
+
+			return nil
+		}
+
+		if atomic.LoadInt64(&inFlight) == 0 {
+			return fmt.Errorf(
+				"only %s free, %s needed: %w",
+				util.FormatBytes(free),
+				util.FormatBytes(needed),
+				syscall.ENOSPC,
+			)
+		}
+
+		if !waiting {
+			logger.Printf(
+				"only %s free, %s needed, pausing downloads until space is freed\n",
+				util.FormatBytes(free),
+				util.FormatBytes(needed),
+			)
+			waiting = true
+		}
+
+		time.Sleep(time.Duration(cfg.Disk.PollInterval) * time.Second)
+	}
+}
+
+// startEntry marks a repo as handed over to the workers
+func startEntry() {
+	atomic.AddInt64(&inFlight, 1)
+}
+
+// finishEntry marks a repo as done with by the workers, successfully or not
+func finishEntry() {
+	atomic.AddInt64(&inFlight, -1)
+}
@@ -2,8 +2,10 @@ package worker
 
 import (
 	"errors"
+	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/aceviralltd/github-backup/internal/config"
 	"github.com/aceviralltd/github-backup/internal/service/aws"
@@ -25,60 +27,272 @@ func InitializeGlacearWorker(cfg *config.Config, bufferSize int) {
 // aws glacier concurrently
 func glacierWorker(logger *log.Logger, cfg *config.Config) {
 	for entry := range glacierQueue {
-		progress, ok := config.CurrentRunProgress[*entry.Repo.Name]
-		if !ok {
-			progress = &config.ProgressEntry{
-				Downloaded: true,
-				Archived:   true,
-				Uploaded:   false,
-			}
-		}
+		progress := config.RunProgress(entry.Repo.Name, config.ProgressEntry{Downloaded: true, Archived: true})
 
 		if progress.Uploaded {
+			finishEntry()
+			continue
+		}
+
+		staged := stagedArchives(cfg, entry)
+
+		// archives staged by an earlier run (or with streaming turned off) are uploaded from disk
+		var uploadErr error
+		if len(staged) > 0 {
+			uploadErr = uploadStaged(logger, cfg, entry, progress, staged)
+		} else {
+			uploadErr = streamArchives(logger, cfg, entry, progress)
+		}
+
+		// the uploaded archives are kept in the progress so the next run only retries the failed ones, either
+		// from their staged files or by streaming them from the paths that were left on disk
+		if uploadErr != nil {
+			progress.Archived = len(staged) > 0
+
+			recordFailure(logger, entry.Repo, cfg, progress, entry.Description, "Failed to upload archive", uploadErr)
+			if len(progress.Archives) > 0 {
+				config.RecordPartialUpload(cfg, entry.Repo.Name, progress.Archives)
+			}
+
+			finishEntry()
 			continue
 		}
 
-		archivePath := cfg.Path.ArchivePath(entry.Repo)
+		archives := progress.Archives
+		archiveId := mainArchiveId(archives)
+
+		progress.Archived = true
+		progress.Uploaded = true
+		config.UpdateProgress(cfg, entry.Repo.Name, *progress)
+
+		if err := commitBundleChain(cfg, entry, archiveId); err != nil {
+			logger.Println("failed to update bundle chain: " + err.Error())
+			util.WriteToLog(cfg, archiveId, entry.Description, errors.New("Failed to update bundle chain: "+err.Error()))
+		}
+
+		// only a complete backup can be relied on when deciding to skip the repo in later runs
+		config.RecordBackup(cfg, entry.Repo.Name, config.BackupRecord{
+			Vault:       cfg.Aws.Vault,
+			ArchiveId:   archiveId,
+			Description: entry.Description,
+			Archives:    archives,
+			Format:      cfg.Archive.Format,
+			BackedUpAt:  time.Now(),
+			PushedAt:    entry.Repo.PushedAt,
+			UpdatedAt:   entry.Repo.UpdatedAt,
+		})
+
+		finishEntry()
+	}
+
+	logger.Println("shutting down")
+	WaitGroup.Done()
+}
+
+// stagedArchives finds the repo archive along with any separate release and actions archives that have
+// been written to disk
+func stagedArchives(cfg *config.Config, entry QueueEntry) []util.Archive {
+	var staged []util.Archive
+
+	// large release assets and actions exports are archived separately so they need their own upload
+	for _, archive := range []util.Archive{
+		{Path: cfg.Path.ArchivePath(entry.Repo)},
+		{Path: cfg.Path.ReleaseArchivePath(entry.Repo), Suffix: ".releases"},
+		{Path: cfg.Path.ActionsArchivePath(entry.Repo), Suffix: ".actions"},
+	} {
+		if _, err := os.Stat(archive.Path); err == nil {
+			staged = append(staged, archive)
+		}
+	}
+
+	return staged
+}
+
+// uploadStaged will upload each of the staged archives from disk
+//
+// each archive is removed and recorded in the progress as soon as it is uploaded so a retry only uploads
+// the archives that failed
+func uploadStaged(
+	logger *log.Logger,
+	cfg *config.Config,
+	entry QueueEntry,
+	progress *config.ProgressEntry,
+	staged []util.Archive,
+) error {
+	var uploadErr error
 
-		logger.Printf("opening %s", archivePath)
+	for _, archive := range staged {
+		if isUploaded(progress, archive) {
+			os.Remove(archive.Path)
+			continue
+		}
 
-		file, err := os.Open(archivePath)
+		vault, description := archiveDestination(cfg, entry, archive)
+		id, err := uploadFile(logger, cfg, vault, archive.Path, description)
 		if err != nil {
-			logger.Println("failed to open archive")
-			util.WriteToLog(cfg, "", entry.Description, errors.New("Failed to open archive"))
+			uploadErr = err
 			continue
 		}
 
-		logger.Println("uploading")
-		archiveId, err := aws.UploadToGlacier(
-			cfg,
-			file,
-			entry.Description,
-		)
+		os.Remove(archive.Path)
+		recordUpload(cfg, entry, progress, archive, vault, id, description)
+	}
+
+	return uploadErr
+}
+
+// streamArchives writes each archive of the repo straight into its upload without staging it on disk
+//
+// the paths of each uploaded archive are removed, the paths of a failed archive are left on disk along
+// with the repo so the next run can stream just that archive again
+func streamArchives(logger *log.Logger, cfg *config.Config, entry QueueEntry, progress *config.ProgressEntry) error {
+	archives, err := util.RepoArchives(cfg, entry.Repo)
+	if err != nil {
+		logger.Println("failed to find archive paths")
+		util.WriteToLog(cfg, "", entry.Description, errors.New("Failed to archive repo: "+err.Error()))
+		return err
+	}
+
+	var uploaded []util.Archive
+	var uploadErr error
+
+	for _, archive := range archives {
+		if isUploaded(progress, archive) {
+			uploaded = append(uploaded, archive)
+			continue
+		}
+
+		paths := archive.Paths
+		vault, description := archiveDestination(cfg, entry, archive)
+
+		logger.Printf("streaming %s", archive.Path)
+		id, err := aws.StreamToGlacier(cfg, vault, description, func(output io.Writer) error {
+			return util.WriteArchive(cfg, output, paths)
+		})
+
+		util.WriteToLog(cfg, id, description, err)
 
 		if err != nil {
 			logger.Println("upload failed")
-		} else {
-			logger.Println("upload complete")
+			uploadErr = err
+			continue
+		}
+
+		logger.Println("upload complete")
+		uploaded = append(uploaded, archive)
+		recordUpload(cfg, entry, progress, archive, vault, id, description)
+	}
+
+	if uploadErr != nil {
+		util.RemoveArchivePaths(cfg, uploaded)
+		return uploadErr
+	}
+
+	util.RemoveArchived(cfg, entry.Repo, archives)
 
-			// we don't actually need to keep any of the archives once they are uploaded
-			os.Remove(archivePath)
+	return nil
+}
+
+// isUploaded checks if the archive was already uploaded by an earlier attempt at the repo
+func isUploaded(progress *config.ProgressEntry, archive util.Archive) bool {
+	for _, record := range progress.Archives {
+		if record.Suffix == archive.Suffix {
+			return true
 		}
+	}
 
-		util.WriteToLog(cfg, archiveId, entry.Description, err)
+	return false
+}
 
-		progress.Uploaded = true
-		config.UpdateProgress(cfg, *entry.Repo.Name, *progress)
+// recordUpload adds an uploaded archive to the progress of the repo straight away so it is not uploaded
+// again if the repo fails
+func recordUpload(
+	cfg *config.Config,
+	entry QueueEntry,
+	progress *config.ProgressEntry,
+	archive util.Archive,
+	vault, archiveId, description string,
+) {
+	progress.Archives = append(progress.Archives, config.ArchiveRecord{
+		Suffix:      archive.Suffix,
+		Vault:       vault,
+		ArchiveId:   archiveId,
+		Description: description,
+	})
 
+	config.UpdateProgress(cfg, entry.Repo.Name, *progress)
+}
+
+// mainArchiveId finds the id of the archive holding the repo itself
+func mainArchiveId(archives []config.ArchiveRecord) string {
+	for _, archive := range archives {
+		if archive.Suffix == "" {
+			return archive.ArchiveId
+		}
 	}
 
-	logger.Println("shutting down")
-	WaitGroup.Done()
+	return ""
+}
+
+// archiveDestination picks the vault and description for one of the repos archives, actions archives
+// can be sent to their own vault
+func archiveDestination(cfg *config.Config, entry QueueEntry, archive util.Archive) (string, string) {
+	switch archive.Suffix {
+	case "":
+		return cfg.Aws.Vault, entry.Description
+	case ".actions":
+		return cfg.ActionsVault(), cfg.ArchiveDescription(entry.Repo.Name + archive.Suffix + cfg.Archive.Extension())
+	}
+
+	return cfg.Aws.Vault, cfg.ArchiveDescription(entry.Repo.Name + archive.Suffix + cfg.Archive.Extension())
+}
+
+// uploadArchive will send a single archive file to the glacier vault, removing it once uploaded
+func uploadArchive(logger *log.Logger, cfg *config.Config, vault, archivePath, description string) (string, error) {
+	archiveId, err := uploadFile(logger, cfg, vault, archivePath, description)
+
+	// we don't actually need to keep any of the archives once they are uploaded
+	if err == nil {
+		os.Remove(archivePath)
+	}
+
+	return archiveId, err
+}
+
+// uploadFile will send a file to the glacier vault and log the outcome
+func uploadFile(logger *log.Logger, cfg *config.Config, vault, archivePath, description string) (string, error) {
+	logger.Printf("opening %s", archivePath)
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		logger.Println("failed to open archive")
+		util.WriteToLog(cfg, "", description, errors.New("Failed to open archive"))
+		return "", err
+	}
+	defer file.Close()
+
+	logger.Println("uploading")
+	archiveId, err := aws.UploadToGlacier(
+		cfg,
+		vault,
+		file,
+		description,
+	)
+
+	if err != nil {
+		logger.Println("upload failed")
+	} else {
+		logger.Println("upload complete")
+	}
+
+	util.WriteToLog(cfg, archiveId, description, err)
+	return archiveId, err
 }
 
 // enqueueUpload handles the sending the job to the glacier worker
 func enqueueGlacierUpload(logger *log.Logger, progress *config.ProgressEntry, entry QueueEntry) {
 	if progress.Uploaded {
+		finishEntry()
 		return
 	}
 
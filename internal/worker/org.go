@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"log"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	githubService "github.com/aceviralltd/github-backup/internal/service/github"
+	"github.com/aceviralltd/github-backup/internal/source"
+)
+
+// BackupOrgSnapshot will export the org configuration and upload it to glacier alongside the repos
+//
+// this should only be called once the repo workers have finished as it shares the progress store
+func BackupOrgSnapshot(logger *log.Logger, cfg *config.Config, repos []*source.Repository) {
+	name := cfg.Github.OrgName + ".org"
+	description := cfg.ArchiveDescription(name)
+	snapshotPath := cfg.Path.OrgSnapshotPath(cfg.Github.OrgName)
+
+	progress := config.RunProgress(name, config.ProgressEntry{})
+
+	if progress.Uploaded {
+		return
+	}
+
+	if !progress.Downloaded {
+		logger.Println("exporting org snapshot")
+		if err := githubService.ExportOrgSnapshot(cfg, repos, snapshotPath, logger); err != nil {
+			recordFailure(logger, &source.Repository{Name: name}, cfg, progress, description, "Failed to export org snapshot", err)
+			return
+		}
+
+		// the snapshot is a single json file so there is no archive step
+		progress.Downloaded = true
+		progress.Archived = true
+		config.UpdateProgress(cfg, name, *progress)
+	}
+
+	// the snapshot is left on disk and retried by the next run if the upload fails
+	if _, err := uploadArchive(logger, cfg, cfg.Aws.Vault, snapshotPath, description); err != nil {
+		recordFailure(logger, &source.Repository{Name: name}, cfg, progress, description, "Failed to upload org snapshot", err)
+		return
+	}
+
+	progress.Uploaded = true
+	config.UpdateProgress(cfg, name, *progress)
+}
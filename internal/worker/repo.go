@@ -0,0 +1,164 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aceviralltd/github-backup/internal/config"
+	"github.com/aceviralltd/github-backup/internal/failure"
+	"github.com/aceviralltd/github-backup/internal/source"
+	"github.com/aceviralltd/github-backup/internal/util"
+)
+
+// ProcessRepo will do all the work really, clone the repo, archive it then pass the path
+// to the glacier worker
+//
+// every source shares this pipeline, they only differ in how the repo is cloned and what is exported with it
+func ProcessRepo(logger *log.Logger, cfg *config.Config, src source.Source, repo *source.Repository) {
+	progress := config.RunProgress(repo.Name, config.ProgressEntry{})
+
+	// if the repo has already been uploaded to glacier then there is nothing to do
+	if progress.Uploaded {
+		return
+	}
+
+	if record, ok := unchangedSinceBackup(cfg, repo); ok {
+		logger.Printf("skipping %s, unchanged since %s", repo.Name, record.BackedUpAt.Format(time.RFC3339))
+		config.RecordUnchanged(cfg, repo.Name, record)
+
+		return
+	}
+
+	logger.Printf("processing %s", repo.Name)
+	// the extension tells a restore which format the archive is in without downloading it
+	description := cfg.ArchiveDescription(repo.Name + cfg.Archive.Extension())
+
+	if !downloadRepo(logger, src, repo, cfg, progress, description) {
+		return
+	}
+
+	enqueueArchive(logger, repo, cfg, progress, description)
+}
+
+// unchangedSinceBackup checks if the repo has been pushed to or updated since its last backup
+//
+// a backup that is older than the max age is always treated as changed so that a full backup is made
+//
+// the check runs before anything is exported, so the issues, releases, settings and actions held in the
+// previous backup of a skipped repo go stale until it is pushed to or reaches the max age
+func unchangedSinceBackup(cfg *config.Config, repo *source.Repository) (config.BackupRecord, bool) {
+	if !cfg.Backup.SkipUnchanged {
+		return config.BackupRecord{}, false
+	}
+
+	record, ok := config.LastBackup(repo.Name)
+	if !ok {
+		return record, false
+	}
+
+	if cfg.Backup.MaxAge > 0 && time.Since(record.BackedUpAt) > cfg.Backup.MaxAgeDuration() {
+		return record, false
+	}
+
+	if repo.PushedAt.After(record.PushedAt) || repo.UpdatedAt.After(record.UpdatedAt) {
+		return record, false
+	}
+
+	return record, true
+}
+
+// download handles the cloning of the repo
+func downloadRepo(
+	logger *log.Logger,
+	src source.Source,
+	repo *source.Repository,
+	cfg *config.Config,
+	progress *config.ProgressEntry,
+	description string,
+) bool {
+	if progress.Downloaded {
+		return true
+	}
+
+	if err := waitForSpace(logger, cfg, repo); err != nil {
+		recordFailure(logger, repo, cfg, progress, description, "Not enough disk space to clone repo", err)
+		return false
+	}
+
+	logger.Println("cloning repo")
+	if err := cloneRepo(logger, src, repo, cfg, progress); err != nil {
+		recordFailure(logger, repo, cfg, progress, description, "Failed to clone repo", err)
+		return false
+	}
+
+	if err := src.Export(repo, logger); err != nil {
+		recordFailure(logger, repo, cfg, progress, description, "Failed to export repo data", err)
+		return false
+	}
+
+	progress.Downloaded = true
+	progress.Failure = ""
+	config.UpdateProgress(cfg, repo.Name, *progress)
+
+	return true
+}
+
+// cloneRepo will download the repo within a timeout scaled by its size, transient failures are retried
+// with an increasing delay while the likes of auth and not found failures are given up on straight away
+func cloneRepo(
+	logger *log.Logger,
+	src source.Source,
+	repo *source.Repository,
+	cfg *config.Config,
+	progress *config.ProgressEntry,
+) error {
+	timeout := cfg.Clone.TimeoutFor(repo.Size)
+
+	for retry := 0; ; retry++ {
+		ctx, cancel := cloneContext(timeout)
+
+		progress.Attempts++
+		err := src.Download(ctx, repo, logger)
+		cancel()
+
+		category := failure.Classify(err)
+		if err == nil || !category.Retryable() || retry >= cfg.Clone.Retries {
+			return err
+		}
+
+		delay := cfg.Clone.RetryDelayFor(retry + 1)
+		logger.Printf("clone failed (%s), retrying in %s: %s\n", category, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// cloneContext limits the clone to the timeout, a zero timeout means there is no limit
+func cloneContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// recordFailure will classify the error and record it in the log, progress store and run catalog
+func recordFailure(
+	logger *log.Logger,
+	repo *source.Repository,
+	cfg *config.Config,
+	progress *config.ProgressEntry,
+	description string,
+	message string,
+	err error,
+) {
+	category := failure.Classify(err)
+
+	logger.Printf("%s (%s): %s\n", message, category, err)
+	util.WriteToLog(cfg, "", description, fmt.Errorf("%s (%s): %w", message, category, err))
+
+	progress.Failure = string(category)
+	config.UpdateProgress(cfg, repo.Name, *progress)
+	config.RecordFailure(cfg, repo.Name, string(category), err)
+}
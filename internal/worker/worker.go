@@ -3,7 +3,7 @@ package worker
 import (
 	"sync"
 
-	"github.com/google/go-github/v34/github"
+	"github.com/aceviralltd/github-backup/internal/source"
 )
 
 var WaitGroup sync.WaitGroup
@@ -11,6 +11,6 @@ var glacierQueue chan QueueEntry
 var ArciveQueue chan QueueEntry
 
 type QueueEntry struct {
-	Repo        *github.Repository
+	Repo        *source.Repository
 	Description string
 }